@@ -0,0 +1,346 @@
+/*
+
+Command-line client for the BlockArt network, built on blockartlib.
+
+Usage:
+go run blockart.go [-miner ip:port] [-key-file path] [-verify config] <command> [arguments]
+
+Commands:
+  add [-validate n] [-fill colour] [-stroke colour] <svg path>
+  delete [-validate n] <shape hash>
+  ink
+  shapes <block hash>
+  svg <shape hash>
+  blocks
+  children <block hash>
+  export [-out path]
+  events [-since n]
+
+The miner address defaults to $BLOCKART_MINER. The private key (hex, as printed by
+generate-key-pair.go) is read from -key-file, or from $BLOCKART_PRIVKEY if no file is given.
+
+With -verify, the client checks the miners against the miner settings of the server config
+instead of trusting them (see blockartlib.OpenVerifyingCanvas). -miner then takes a comma
+separated list of miners to cross-check.
+
+Every command prints a JSON object on stdout. On failure a JSON object with the error is
+printed on stderr and the exit code identifies the blockartlib error type (see the Exit constants).
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"./blockartlib"
+)
+
+// Exit codes of the client, one for each blockartlib error type.
+const (
+	ExitOK = iota
+	ExitUsage
+	ExitOther
+	ExitDisconnected
+	ExitInsufficientInk
+	ExitInvalidShapeSvgString
+	ExitShapeSvgStringTooLong
+	ExitInvalidShapeHash
+	ExitShapeOwner
+	ExitOutOfBounds
+	ExitShapeOverlap
+	ExitInvalidBlockHash
+	ExitInvalidKey
+	ExitSessionLimit
+	ExitRegionReserved
+	ExitInvalidProof
+)
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+type errorOutput struct {
+	Error string `json:"error"`
+	Type  string `json:"type"`
+}
+
+func main() {
+	minerAddr := flag.String("miner", os.Getenv("BLOCKART_MINER"), "miner ip:port (default $BLOCKART_MINER)")
+	keyFile := flag.String("key-file", "", "file containing the hex encoded private key (default $BLOCKART_PRIVKEY)")
+	verifyConfig := flag.String("verify", "", "server config to verify the miners against; -miner is then a comma separated list")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		printUsage()
+		os.Exit(ExitUsage)
+	}
+
+	output, err := run(*minerAddr, *keyFile, *verifyConfig, flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		exitWithError(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(output)
+}
+
+// Opens a canvas on the miner, or a verifying canvas on the miners if verifyConfig is set, and
+// runs the command on it. Returns the value to print as JSON.
+func run(minerAddr string, keyFile string, verifyConfig string, command string, args []string) (interface{}, error) {
+	flags, opts, expectedArgs, err := commandFlags(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError(err.Error())
+	}
+	if flags.NArg() != expectedArgs {
+		return nil, usageError(fmt.Sprintf("%s expects %d argument(s)", command, expectedArgs))
+	}
+
+	if minerAddr == "" {
+		return nil, usageError("no miner address, use -miner or $BLOCKART_MINER")
+	}
+
+	privKey, err := readPrivateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	canvas, settings, err := openCanvas(minerAddr, *privKey, verifyConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer canvas.CloseCanvas()
+
+	switch command {
+	case "add":
+		shapeHash, blockHash, ink, err := canvas.AddShape(uint8(opts.validateNum), blockartlib.PATH, flags.Arg(0), opts.fill, opts.stroke)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"shapeHash": shapeHash, "blockHash": blockHash, "inkRemaining": ink}, nil
+
+	case "delete":
+		ink, err := canvas.DeleteShape(uint8(opts.validateNum), flags.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"inkRemaining": ink}, nil
+
+	case "ink":
+		ink, err := canvas.GetInk()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"inkRemaining": ink}, nil
+
+	case "shapes":
+		shapeHashes, err := canvas.GetShapes(flags.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"shapeHashes": nonNil(shapeHashes)}, nil
+
+	case "svg":
+		svgString, err := canvas.GetSvgString(flags.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"svgString": svgString}, nil
+
+	case "blocks":
+		blockHashes, err := blockartlib.GetLongestChain(canvas)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"blockHashes": nonNil(blockHashes)}, nil
+
+	case "children":
+		blockHashes, err := canvas.GetChildren(flags.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"blockHashes": nonNil(blockHashes)}, nil
+
+	case "events":
+		events, err := canvas.GetOperationEvents(opts.since)
+		if err != nil {
+			return nil, err
+		}
+		if events == nil {
+			events = []blockartlib.OperationEvent{}
+		}
+		return map[string]interface{}{"events": events}, nil
+
+	case "export":
+		svgs, err := blockartlib.GetAllSVGs(canvas)
+		if err != nil {
+			return nil, err
+		}
+
+		svg := blockartlib.ConstructCanvasSvg(svgs, settings)
+		if opts.out == "" {
+			return map[string]interface{}{"svg": svg, "shapes": len(svgs)}, nil
+		}
+
+		if err := ioutil.WriteFile(opts.out, []byte(svg), 0644); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"out": opts.out, "shapes": len(svgs)}, nil
+	}
+
+	return nil, usageError("unknown command " + command)
+}
+
+// Values of the flags a command takes.
+type commandOptions struct {
+	validateNum uint
+	fill        string
+	stroke      string
+	out         string
+	since       uint64
+}
+
+// Returns the flag set of the command, holding only the flags it takes, the options they are
+// parsed into, and the number of arguments the command expects.
+func commandFlags(command string) (*flag.FlagSet, *commandOptions, int, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	opts := &commandOptions{}
+
+	switch command {
+	case "add":
+		flags.UintVar(&opts.validateNum, "validate", 2, "number of blocks that have to follow the operation's block")
+		flags.StringVar(&opts.fill, "fill", "transparent", "fill colour of the shape")
+		flags.StringVar(&opts.stroke, "stroke", "black", "stroke colour of the shape")
+		return flags, opts, 1, nil
+	case "delete":
+		flags.UintVar(&opts.validateNum, "validate", 2, "number of blocks that have to follow the operation's block")
+		return flags, opts, 1, nil
+	case "shapes", "svg", "children":
+		return flags, opts, 1, nil
+	case "ink", "blocks":
+		return flags, opts, 0, nil
+	case "export":
+		flags.StringVar(&opts.out, "out", "", "file to write the canvas svg to (default stdout)")
+		return flags, opts, 0, nil
+	case "events":
+		flags.Uint64Var(&opts.since, "since", 0, "number of the last operation event already seen")
+		return flags, opts, 0, nil
+	}
+
+	return nil, nil, 0, usageError("unknown command " + command)
+}
+
+func openCanvas(minerAddr string, privKey ecdsa.PrivateKey, verifyConfig string) (blockartlib.Canvas, blockartlib.CanvasSettings, error) {
+	if verifyConfig == "" {
+		return blockartlib.OpenCanvas(minerAddr, privKey)
+	}
+
+	netSettings, err := blockartlib.ReadNetSettings(verifyConfig)
+	if err != nil {
+		return nil, blockartlib.CanvasSettings{}, usageError(err.Error())
+	}
+
+	return blockartlib.OpenVerifyingCanvas(strings.Split(minerAddr, ","), privKey, netSettings)
+}
+
+// Reads the hex encoded private key from keyFile, or from $BLOCKART_PRIVKEY if keyFile is empty.
+func readPrivateKey(keyFile string) (*ecdsa.PrivateKey, error) {
+	encoded := os.Getenv("BLOCKART_PRIVKEY")
+	if keyFile != "" {
+		contents, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, usageError(err.Error())
+		}
+		encoded = string(contents)
+	}
+
+	if encoded == "" {
+		return nil, usageError("no private key, use -key-file or $BLOCKART_PRIVKEY")
+	}
+
+	keyBytes, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, blockartlib.InvalidKeyError(err.Error())
+	}
+
+	privKey, err := x509.ParseECPrivateKey(keyBytes)
+	if err != nil {
+		return nil, blockartlib.InvalidKeyError(err.Error())
+	}
+
+	return privKey, nil
+}
+
+// Maps the error to its exit code and the name of its type.
+func classifyError(err error) (int, string) {
+	switch err.(type) {
+	case usageError:
+		return ExitUsage, "UsageError"
+	case blockartlib.DisconnectedError:
+		return ExitDisconnected, "DisconnectedError"
+	case blockartlib.InsufficientInkError:
+		return ExitInsufficientInk, "InsufficientInkError"
+	case blockartlib.InvalidShapeSvgStringError:
+		return ExitInvalidShapeSvgString, "InvalidShapeSvgStringError"
+	case blockartlib.ShapeSvgStringTooLongError:
+		return ExitShapeSvgStringTooLong, "ShapeSvgStringTooLongError"
+	case blockartlib.InvalidShapeHashError:
+		return ExitInvalidShapeHash, "InvalidShapeHashError"
+	case blockartlib.ShapeOwnerError:
+		return ExitShapeOwner, "ShapeOwnerError"
+	case blockartlib.OutOfBoundsError:
+		return ExitOutOfBounds, "OutOfBoundsError"
+	case blockartlib.ShapeOverlapError:
+		return ExitShapeOverlap, "ShapeOverlapError"
+	case blockartlib.InvalidBlockHashError:
+		return ExitInvalidBlockHash, "InvalidBlockHashError"
+	case blockartlib.InvalidKeyError:
+		return ExitInvalidKey, "InvalidKeyError"
+	case blockartlib.SessionLimitError:
+		return ExitSessionLimit, "SessionLimitError"
+	case blockartlib.RegionReservedError:
+		return ExitRegionReserved, "RegionReservedError"
+	case blockartlib.InvalidProofError:
+		return ExitInvalidProof, "InvalidProofError"
+	}
+
+	return ExitOther, "Error"
+}
+
+func exitWithError(err error) {
+	code, errType := classifyError(err)
+
+	output, _ := json.Marshal(errorOutput{Error: err.Error(), Type: errType})
+	fmt.Fprintln(os.Stderr, string(output))
+
+	os.Exit(code)
+}
+
+// Keeps empty results as [] instead of null in the JSON output.
+func nonNil(hashes []string) []string {
+	if hashes == nil {
+		return []string{}
+	}
+	return hashes
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: blockart [-miner ip:port] [-key-file path] [-verify config] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands: add, delete, ink, shapes, svg, blocks, children, export, events")
+	flag.PrintDefaults()
+}
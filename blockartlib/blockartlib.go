@@ -8,20 +8,29 @@ library (blockartlib) to be used in project 1 of UBC CS 416 2017W2.
 package blockartlib
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	mrand "math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
@@ -37,17 +46,22 @@ const (
 	// CIRCLE
 )
 
+// Limits for region reservations: a reservation lasts at most MaxReserveBlocks blocks and
+// costs one unit of ink for every ReserveAreaPerInk pixels reserved for one block.
+const (
+	MaxReserveBlocks  = 100
+	ReserveAreaPerInk = 100
+)
+
 type Block struct {
-	PreviousBlock  *Block
-	PreviousHash   string
-	Hash           string
-	SetOPs         []Operation
-	MinerPubKey    ecdsa.PublicKey
-	Nonce          uint32
-	TotalInkAmount uint32 // Total = Bank - Opcost (+ Reward when you mine the block)
-	InkBank        uint32 // Bank  = Previous block total (with same pubkey as yourself)
-	PathLength     int
-	IsEndBlock     bool
+	PreviousBlock *Block
+	PreviousHash  string
+	Hash          string
+	SetOPs        []Operation
+	MinerPubKey   ecdsa.PublicKey
+	Nonce         uint32
+	PathLength    int
+	IsEndBlock    bool
 }
 
 type Operation struct {
@@ -68,6 +82,27 @@ type Operation struct {
 	Lines          []Line
 	DeleteUniqueID string
 	PathShape      string
+
+	// Only set for "Reserve" operations
+	Region        Rect
+	ReserveBlocks int
+
+	// Milliseconds since the epoch after which the operation can no longer go in a block
+	Expires int64
+
+	// Set by miners that dropped the body of the operation (see MinerNetSettings.PruneOperations),
+	// together with the digest of the body, from which and the fields kept the leaf of the
+	// operation in the Merkle tree of its block is recomputed (see MerkleLeaf)
+	Pruned   bool
+	BodyHash []byte
+}
+
+// Axis-aligned rectangle of the canvas claimed by a reservation.
+type Rect struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
 }
 
 var canvasSettings CanvasSettings
@@ -75,8 +110,8 @@ var canvasSettings CanvasSettings
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
-	CanvasXMax uint32
-	CanvasYMax uint32
+	CanvasXMax uint32 `json:"canvas-x-max"`
+	CanvasYMax uint32 `json:"canvas-y-max"`
 }
 
 // A CanvasObj will have the information about miners on the canvas
@@ -87,12 +122,63 @@ type CanvasObj struct {
 	ArtNodeID    int
 }
 
+// Proof of key ownership sent to the miner: R and S sign the nonce (Hash) issued by the miner.
 type ArtNodeKey struct {
 	ArtNodeID int
+	PubKey    ecdsa.PublicKey
 	R, S      *big.Int
 	Hash      []byte
 }
 
+// Status of an art node session on a miner, as returned by GetSessions.
+type SessionStatus struct {
+	ID          int
+	ArtNodeID   int
+	PubKey      ecdsa.PublicKey
+	ConnectedAt time.Time
+	PendingOps  []string
+	InkSpent    uint32
+}
+
+// One step in the lifecycle of a shape, as returned by ShapeHistory.
+type ShapeEvent struct {
+	// "Add" for the operation that created the shape, otherwise the type of the operation targeting it
+	OpType        string
+	OpHash        string
+	ArtNodePubKey ecdsa.PublicKey
+
+	// Block containing the operation and its height (the genesis block has height 1)
+	BlockHash   string
+	BlockHeight int
+
+	// False if the block is on a fork that is not part of the miner's longest chain
+	OnLongestChain bool
+}
+
+// What happened to an operation after the miner confirmed it to the art node (see
+// GetOperationEvents).
+type OperationEvent struct {
+	// Increasing number of the event on the miner
+	Seq    uint64
+	OpHash string
+
+	// OpDropped, OpReincluded or OpInvalidated
+	Type string
+
+	// Block of the longest chain the operation is in again (OpReincluded), or why it can no
+	// longer be mined (OpInvalidated)
+	BlockHash string
+	Reason    string
+}
+
+// Types of operation events: the block of the operation left the longest chain and the operation
+// waits to be mined again; it is in a block of the longest chain again; it will not be mined again.
+const (
+	OpDropped     = "Dropped"
+	OpReincluded  = "Reincluded"
+	OpInvalidated = "Invalidated"
+)
+
 type Line struct {
 	Start Point
 	End   Point
@@ -106,27 +192,177 @@ type Point struct {
 // Settings for an instance of the BlockArt project/network.
 type MinerNetSettings struct {
 	// Hash of the very first (empty) block in the chain.
-	GenesisBlockHash string
+	GenesisBlockHash string `json:"genesis-block-hash"`
 
 	// The minimum number of ink miners that an ink miner should be
 	// connected to. If the ink miner dips below this number, then
 	// they have to retrieve more nodes from the server using
 	// GetNodes().
-	MinNumMinerConnections uint8
+	MinNumMinerConnections uint8 `json:"min-num-miner-connections"`
 
 	// Mining ink reward per op and no-op blocks (>= 1)
-	InkPerOpBlock   uint32
-	InkPerNoOpBlock uint32
+	InkPerOpBlock   uint32 `json:"ink-per-op-block"`
+	InkPerNoOpBlock uint32 `json:"ink-per-no-op-block"`
 
 	// Number of milliseconds between heartbeat messages to the server.
-	HeartBeat uint32
+	HeartBeat uint32 `json:"heartbeat"`
 
 	// Proof of work difficulty: number of zeroes in prefix (>=0)
-	PoWDifficultyOpBlock   uint8
-	PoWDifficultyNoOpBlock uint8
+	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
+	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 
 	// Canvas settings
-	CanvasSettings CanvasSettings
+	CanvasSettings CanvasSettings `json:"canvas-settings"`
+
+	// Blocks between checkpoints of the chain state (0 disables checkpoints). Miners do not
+	// switch to forks below the last checkpoint.
+	CheckpointInterval uint32 `json:"checkpoint-interval"`
+
+	// Whether miners drop the bodies of operations older than the last checkpoint
+	// that are not live shapes.
+	PruneOperations bool `json:"prune-operations"`
+
+	// Contents of the genesis block. GenesisBlockHash is derived from them and every
+	// miner checks that it matches.
+	Genesis GenesisSettings `json:"genesis"`
+
+	// Milliseconds the network aims to spend on a block, and the number of blocks after
+	// which the proof of work target is adjusted toward it (0 disables retargeting).
+	TargetBlockInterval uint32 `json:"target-block-interval"`
+	RetargetWindow      uint32 `json:"retarget-window"`
+}
+
+// Largest value of a block hash. A block hash, read as a big-endian number, has to be at
+// most the target of the block.
+var MaxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// Version of the block header. Miners reject blocks with any other version.
+const BlockVersion = 1
+
+// Curve of the keys of art nodes and miners (see generate-key-pair.go). Signatures by keys on any
+// other curve are rejected (see CheckPublicKey).
+var KeyCurve = elliptic.P384()
+
+// The fields of a block its hash is computed over (see BlockHeader.Hash). The operations are
+// covered by the root of their Merkle tree (see MerkleRoot).
+type BlockHeader struct {
+	Version      uint32
+	PreviousHash string
+	MerkleRoot   []byte
+	MinerPubKey  ecdsa.PublicKey
+	Nonce        uint32
+	ExtraNonce   uint64
+	Timestamp    int64
+	Target       *big.Int
+}
+
+// One step from a leaf to the root of a Merkle tree: the hash of the sibling node, and whether
+// the sibling is on the left.
+type MerkleStep struct {
+	Hash []byte
+	Left bool
+}
+
+// Shows that an operation is in the block with the header: the branch leads from the leaf of
+// the operation to the Merkle root of the header (see VerifyOperationProof).
+type OperationProof struct {
+	Operation Operation
+	Header    BlockHeader
+	Branch    []MerkleStep
+}
+
+// Limit on how much one retarget can change the target, in either direction.
+const MaxRetargetFactor = 4
+
+// Limits on block timestamps: at most MaxFutureBlockTime ahead of the local clock, and after the
+// median timestamp of the last MedianTimeBlocks blocks.
+const (
+	MaxFutureBlockTime = 2 * time.Minute
+	MedianTimeBlocks   = 11
+)
+
+// Art nodes let their operations expire OperationLifetime after they sign them. Miners take
+// operations into a block only until they expire, and only if they expire at most
+// MaxOperationLifetime after the block, so that they can forget old operations without them
+// being replayed.
+const (
+	OperationLifetime    = 10 * time.Minute
+	MaxOperationLifetime = time.Hour
+)
+
+// Ink handed out and shapes placed on the canvas by the genesis block.
+type GenesisSettings struct {
+	Allocations []GenesisAllocation `json:"allocations"`
+	Shapes      []GenesisShape      `json:"shapes"`
+}
+
+// Ink a key has when the chain starts.
+type GenesisAllocation struct {
+	PubKey string `json:"pub-key"` // hex encoded PKIX public key
+	Ink    uint32 `json:"ink"`
+}
+
+// Path shape owned by PubKey from the start. It costs no ink, and no ink is refunded when
+// it is deleted.
+type GenesisShape struct {
+	PubKey    string `json:"pub-key"` // hex encoded PKIX public key
+	SvgString string `json:"svg-string"`
+	Fill      string `json:"fill"`
+	Stroke    string `json:"stroke"`
+}
+
+// Version of the chain export format written by "ink-miner export".
+const ChainExportVersion = 1
+
+// A block chain exported by "ink-miner export" (see README.txt for the format). Every block
+// comes after its parent. The genesis block itself is not included.
+type ChainExport struct {
+	Version          int             `json:"version"`
+	GenesisBlockHash string          `json:"genesisBlockHash"`
+	Blocks           []ExportedBlock `json:"blocks"`
+}
+
+type ExportedBlock struct {
+	Hash         string              `json:"hash"`
+	Version      uint32              `json:"version"`
+	PreviousHash string              `json:"previousHash"`
+	Height       int                 `json:"height"`     // the genesis block has height 1
+	MerkleRoot   string              `json:"merkleRoot"` // hex
+	Nonce        uint32              `json:"nonce"`
+	ExtraNonce   uint64              `json:"extraNonce"`
+	Timestamp    int64               `json:"timestamp"`   // milliseconds since the epoch
+	Target       string              `json:"target"`      // hex
+	MinerPubKey  string              `json:"minerPubKey"` // hex encoded PKIX public key
+	Operations   []ExportedOperation `json:"operations"`
+}
+
+type ExportedOperation struct {
+	UniqueID      string    `json:"uniqueId"`
+	OpType        string    `json:"opType"` // "Add", "Delete" or "Reserve"
+	ShapeType     ShapeType `json:"shapeType"`
+	ArtNodeID     int       `json:"artNodeId"`
+	ArtNodePubKey string    `json:"artNodePubKey"` // hex encoded PKIX public key
+	SignatureR    string    `json:"signatureR"`    // hex
+	SignatureS    string    `json:"signatureS"`    // hex
+	ValidateNum   int       `json:"validateNum"`
+	InkCost       uint32    `json:"inkCost"`
+	Expires       int64     `json:"expires"` // milliseconds since the epoch
+
+	// "Add" operations
+	SvgString string `json:"svgString,omitempty"`
+	Fill      string `json:"fill,omitempty"`
+	Stroke    string `json:"stroke,omitempty"`
+
+	// "Delete" operations
+	DeleteShapeHash string `json:"deleteShapeHash,omitempty"`
+
+	// "Reserve" operations
+	Region        *Rect `json:"region,omitempty"`
+	ReserveBlocks int   `json:"reserveBlocks,omitempty"`
+
+	// Set if the miner had pruned the body of the operation, with the digest of the body
+	Pruned   bool   `json:"pruned,omitempty"`
+	BodyHash string `json:"bodyHash,omitempty"` // hex
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -203,11 +439,32 @@ func (e InvalidBlockHashError) Error() string {
 	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
 }
 
+// Contains the reason a proof returned by the miner does not verify.
+type InvalidProofError string
+
+func (e InvalidProofError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid proof [%s]", string(e))
+}
+
 // SELF MADE: Contains Private/Public Key that is not validated by the Miner.
 type InvalidKeyError string
 
 func (e InvalidKeyError) Error() string {
-	return fmt.Sprintf("BlockArt: Public Key is not validated", string(e))
+	return fmt.Sprintf("BlockArt: Public Key is not validated [%s]", string(e))
+}
+
+// Contains the session limit of the miner that was exceeded.
+type SessionLimitError string
+
+func (e SessionLimitError) Error() string {
+	return fmt.Sprintf("BlockArt: Session limit reached [%s]", string(e))
+}
+
+// Contains the hash of the reservation that covers the requested shape or region.
+type RegionReservedError string
+
+func (e RegionReservedError) Error() string {
+	return fmt.Sprintf("BlockArt: Region is reserved by someone else [%s]", string(e))
 }
 
 // </ERROR DEFINITIONS>
@@ -223,14 +480,45 @@ type Canvas interface {
 	// - ShapeSvgStringTooLongError
 	// - ShapeOverlapError
 	// - OutOfBoundsError
+	// - RegionReservedError
 	AddShape(validateNum uint8, shapeType ShapeType, shapeSvgString string, fill string, stroke string) (shapeHash string, blockHash string, inkRemaining uint32, err error)
 
+	// Reserves the rectangle (xMin, yMin)-(xMax, yMax) for this key during the next numBlocks
+	// blocks. Other keys cannot add shapes inside the region while the reservation is active.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InsufficientInkError
+	// - OutOfBoundsError
+	// - RegionReservedError
+	ReserveRegion(validateNum uint8, xMin, yMin, xMax, yMax float64, numBlocks uint32) (reservationHash string, blockHash string, inkRemaining uint32, err error)
+
 	// Returns the encoding of the shape as an svg string.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - InvalidShapeHashError
 	GetSvgString(shapeHash string) (svgString string, err error)
 
+	// Returns the operations that added and later targeted the shape (e.g. deleted it), in
+	// order of block height, including copies of them on forks off the longest chain.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	ShapeHistory(shapeHash string) (history []ShapeEvent, err error)
+
+	// Returns a proof that the shape is in a block of the miner's longest chain, which only
+	// needs the block header to check. The proof is verified before it is returned.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	// - InvalidProofError
+	GetOperationProof(shapeHash string) (proof OperationProof, err error)
+
+	// Returns the events of the operations the miner confirmed to this key that come after
+	// the event numbered since (0 for every event the miner kept), oldest first.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetOperationEvents(since uint64) (events []OperationEvent, err error)
+
 	// Returns the amount of ink currently available.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -259,6 +547,17 @@ type Canvas interface {
 	// - InvalidBlockHashError
 	GetChildren(blockHash string) (blockHashes []string, err error)
 
+	// Returns the hashes of the blocks on the chain with the most work, starting with the
+	// genesis block.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetLongestChain() (blockHashes []string, err error)
+
+	// Returns the art node sessions of the miner this canvas is connected to.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetSessions() (sessions []SessionStatus, err error)
+
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
@@ -274,6 +573,8 @@ type Canvas interface {
 //
 // Can return the following errors:
 // - DisconnectedError
+// - InvalidKeyError
+// - SessionLimitError
 func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
@@ -290,11 +591,28 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 		return nil, setting, DisconnectedError(minerAddr)
 	}
 
-	r, s, _ := ecdsa.Sign(rand.Reader, &privKey, []byte("This is the private key!"))
+	// the miner issues a fresh nonce that has to be signed to prove ownership of privKey
+	var nonce []byte
+	err = cli.Call("ArtKey.GetNonce", "", &nonce)
+	if err != nil {
+		return nil, setting, DisconnectedError(minerAddr)
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, nonce)
+	if err != nil {
+		return nil, setting, InvalidKeyError(err.Error())
+	}
 
-	err = cli.Call("ArtKey.ValidateKey", ArtNodeKey{ArtNodeID: artNodeID, R: r, S: s, Hash: []byte("This is the private key!")}, &setting)
+	err = cli.Call("ArtKey.ValidateKey", ArtNodeKey{ArtNodeID: artNodeID, PubKey: privKey.PublicKey, R: r, S: s, Hash: nonce}, &setting)
 
 	if err != nil {
+		cli.Close()
+		switch err := decodeMinerError(err, minerAddr).(type) {
+		case InvalidKeyError:
+			return nil, setting, InvalidKeyError(minerAddr)
+		case SessionLimitError:
+			return nil, setting, err
+		}
 		return nil, setting, DisconnectedError(minerAddr)
 	}
 
@@ -316,7 +634,7 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 func (canvasObj CanvasObj) CloseCanvas() (inkRemaining uint32, err error) {
 	var reply uint32
 
-	err = canvasObj.MinerCli.Call("ArtKey.GetInk", "", &reply)
+	err = canvasObj.MinerCli.Call("ArtKey.CloseCanvas", "", &reply)
 	if err != nil {
 		return uint32(0), DisconnectedError(canvasObj.MinerAddress)
 	}
@@ -326,6 +644,18 @@ func (canvasObj CanvasObj) CloseCanvas() (inkRemaining uint32, err error) {
 	return reply, err
 }
 
+// Returns the art node sessions of the miner this canvas is connected to.
+// Can return the following errors:
+// - DisconnectedError
+func (canvasObj CanvasObj) GetSessions() (sessions []SessionStatus, err error) {
+	err = canvasObj.MinerCli.Call("ArtKey.GetSessions", "", &sessions)
+	if err != nil {
+		return nil, DisconnectedError(canvasObj.MinerAddress)
+	}
+
+	return sessions, nil
+}
+
 // Retrieves the children blocks of the block identified by blockHash.
 // Can return the following errors:
 // - DisconnectedError
@@ -345,6 +675,46 @@ func (canvasObj CanvasObj) GetChildren(blockHash string) (blockHashes []string,
 	return reply, nil
 }
 
+// Returns the hashes of the blocks on the miner's longest chain, which the miner picks by work,
+// starting with the genesis block. The headers are fetched in batches after the last block
+// received so far.
+// Can return the following errors:
+// - DisconnectedError
+func (canvasObj CanvasObj) GetLongestChain() (blockHashes []string, err error) {
+	genesisHash, err := canvasObj.GetGenesisBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	blockHashes = []string{genesisHash}
+	for {
+		var headers []BlockHeader
+		locator := []string{blockHashes[len(blockHashes)-1]}
+		if err := canvasObj.MinerCli.Call("ArtKey.GetHeaders", locator, &headers); err != nil {
+			return nil, decodeMinerError(err, canvasObj.MinerAddress)
+		}
+
+		if len(headers) == 0 {
+			return blockHashes, nil
+		}
+
+		// the miner starts after an earlier block if its longest chain changed in between
+		for i := len(blockHashes) - 1; i >= 0; i-- {
+			if blockHashes[i] == headers[0].PreviousHash {
+				blockHashes = blockHashes[:i+1]
+				break
+			}
+		}
+		if blockHashes[len(blockHashes)-1] != headers[0].PreviousHash {
+			return nil, errors.New("BlockArt: headers of the longest chain do not follow a known block")
+		}
+
+		for _, header := range headers {
+			blockHashes = append(blockHashes, header.Hash())
+		}
+	}
+}
+
 // Returns the block hash of the genesis block.
 // Can return the following errors:
 // - DisconnectedError
@@ -370,55 +740,19 @@ func (canvasObj CanvasObj) AddShape(validateNum uint8, shapeType ShapeType, shap
 	// address := canvasObj.MinerAddress
 
 	// - ShapeSvgStringTooLongError
-	if !HandleSvgStringLength(shapeSvgString) {
-		return "", "", inkRemaining, ShapeSvgStringTooLongError(shapeSvgString)
-	}
-
-	svgArray := strings.Split(shapeSvgString, " ")
-
 	// - InvalidShapeSvgStringError TODO: when fill or stroke is empty https://piazza.com/class/jbyh5bsk4ez3cn?cid=414
-	if checkValidFillAndStroke(fill, stroke) == false {
-		return "", "", inkRemaining, InvalidShapeSvgStringError(shapeSvgString)
-	}
-
-	if checkValidSvgArray(svgArray) == false {
-		return "", "", inkRemaining, InvalidShapeSvgStringError(shapeSvgString)
-	}
-
 	// - OutOfBoundsError
-	boundCheck := GetCoordinates(svgArray)
-
-	if !BoundCheck(boundCheck) {
-		boundsErr := OutOfBoundsError{}
-		return "", "", inkRemaining, OutOfBoundsError(boundsErr)
+	linesToDraw, inkReq, err := ParseShape(shapeSvgString, fill, stroke, canvasSettings)
+	if err != nil {
+		return "", "", inkRemaining, err
 	}
 
-	// calculate amount of ink that this shape will use
-	inkReq := CalcInkUsed(boundCheck, fill)
-
-	nodePrivKey := canvasObj.PrivateKey
-
-	r, s, _ := ecdsa.Sign(rand.Reader, &nodePrivKey, []byte("This is the private key!"))
-
-	shapeHash = r.String() + s.String()
-
-	// shape hash will only take on unique value for r, but for op-sig validation we should pass
-	// in r and s but we will only need to look at r values for shapeHash validation?
-
-	//set the coordinates
-
 	pathShape := ConstructSvgString(shapeType, shapeSvgString, fill, stroke)
 
-	linesToDraw := GetCoordinates(svgArray)
-
-	var reply Block
-	err = canvasObj.MinerCli.Call("ArtKey.AddShape", Operation{
+	operation := Operation{
 		ArtNodeID:      canvasObj.ArtNodeID,
-		UniqueID:       shapeHash,
 		ArtNodePubKey:  canvasObj.PrivateKey.PublicKey,
 		OpInkCost:      inkReq,
-		OPSigR:         r,
-		OPSigS:         s,
 		OpType:         "Add",
 		ValidateNum:    int(validateNum),
 		ShapeType:      shapeType,
@@ -427,20 +761,73 @@ func (canvasObj CanvasObj) AddShape(validateNum uint8, shapeType ShapeType, shap
 		Stroke:         stroke,
 		Lines:          linesToDraw,
 		PathShape:      pathShape,
-	}, &reply)
+		Expires:        time.Now().Add(OperationLifetime).UnixNano() / int64(time.Millisecond),
+	}
+	if err := SignOperation(&operation, canvasObj.PrivateKey); err != nil {
+		return "", "", inkRemaining, err
+	}
+	shapeHash = operation.UniqueID
+
+	var reply Block
+	err = canvasObj.MinerCli.Call("ArtKey.AddShape", operation, &reply)
 
 	if err != nil {
-		if err.Error() == "connection is shut down" {
-			return "", "", inkRemaining, DisconnectedError(canvasObj.MinerAddress)
-		}
+		return "", "", inkRemaining, decodeMinerError(err, canvasObj.MinerAddress)
+	}
+
+	if reply.Hash == "" {
+		return "", "", 0, errors.New("Timed out, operation not validated")
+	}
+
+	inkRemaining, err = canvasObj.GetInk()
+	return shapeHash, reply.Hash, inkRemaining, err
+}
+
+// Reserves the rectangle (xMin, yMin)-(xMax, yMax) for this key during the next numBlocks blocks.
+// Can return the following errors:
+// - DisconnectedError
+// - InsufficientInkError
+// - OutOfBoundsError
+// - RegionReservedError
+func (canvasObj CanvasObj) ReserveRegion(validateNum uint8, xMin, yMin, xMax, yMax float64, numBlocks uint32) (reservationHash string, blockHash string, inkRemaining uint32, err error) {
+	region := Rect{MinX: xMin, MinY: yMin, MaxX: xMax, MaxY: yMax}
+
+	if xMin < 0 || yMin < 0 || xMin >= xMax || yMin >= yMax || xMax > float64(canvasSettings.CanvasXMax) || yMax > float64(canvasSettings.CanvasYMax) {
+		return "", "", inkRemaining, OutOfBoundsError{}
+	}
+
+	if numBlocks < 1 || numBlocks > MaxReserveBlocks {
+		return "", "", inkRemaining, fmt.Errorf("BlockArt: Reservation must last between 1 and %d blocks", MaxReserveBlocks)
+	}
+
+	operation := Operation{
+		ArtNodeID:     canvasObj.ArtNodeID,
+		ArtNodePubKey: canvasObj.PrivateKey.PublicKey,
+		OpInkCost:     CalcReserveInk(region, numBlocks),
+		OpType:        "Reserve",
+		ValidateNum:   int(validateNum),
+		Region:        region,
+		ReserveBlocks: int(numBlocks),
+		Expires:       time.Now().Add(OperationLifetime).UnixNano() / int64(time.Millisecond),
+	}
+	if err := SignOperation(&operation, canvasObj.PrivateKey); err != nil {
 		return "", "", inkRemaining, err
 	}
+	reservationHash = operation.UniqueID
+
+	var reply Block
+	err = canvasObj.MinerCli.Call("ArtKey.ReserveRegion", operation, &reply)
+
+	if err != nil {
+		return "", "", inkRemaining, decodeMinerError(err, canvasObj.MinerAddress)
+	}
 
 	if reply.Hash == "" {
 		return "", "", 0, errors.New("Timed out, operation not validated")
 	}
 
-	return shapeHash, reply.Hash, reply.TotalInkAmount, err
+	inkRemaining, err = canvasObj.GetInk()
+	return reservationHash, reply.Hash, inkRemaining, err
 }
 
 // Returns the encoding of the shape as an svg string.
@@ -459,6 +846,11 @@ func (canvasObj CanvasObj) GetSvgString(shapeHash string) (svgString string, err
 		return "", DisconnectedError(address)
 	}
 
+	// reservations are not drawn on the canvas
+	if reply.OpType == "Reserve" {
+		return "", InvalidShapeHashError(shapeHash)
+	}
+
 	shapeType := reply.ShapeType
 	fill := reply.Fill
 	stroke := reply.Stroke
@@ -469,6 +861,87 @@ func (canvasObj CanvasObj) GetSvgString(shapeHash string) (svgString string, err
 	return svgString, err
 }
 
+// Returns the operations that added and later targeted the shape, in order of block height.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (canvasObj CanvasObj) ShapeHistory(shapeHash string) (history []ShapeEvent, err error) {
+	err = canvasObj.MinerCli.Call("ArtKey.GetShapeHistory", shapeHash, &history)
+	if err != nil {
+		if err.Error() == "Does not exist" {
+			return nil, InvalidShapeHashError(shapeHash)
+		}
+		return nil, DisconnectedError(canvasObj.MinerAddress)
+	}
+
+	return history, nil
+}
+
+// Returns a proof that the shape is in a block of the miner's longest chain, verified with
+// VerifyOperationProof.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+// - InvalidProofError
+func (canvasObj CanvasObj) GetOperationProof(shapeHash string) (proof OperationProof, err error) {
+	err = canvasObj.MinerCli.Call("ArtKey.GetOperationProof", shapeHash, &proof)
+	if err != nil {
+		if err.Error() == "Does not exist" {
+			return OperationProof{}, InvalidShapeHashError(shapeHash)
+		}
+		return OperationProof{}, DisconnectedError(canvasObj.MinerAddress)
+	}
+
+	if proof.Operation.UniqueID != shapeHash {
+		return OperationProof{}, InvalidProofError("proof is for another operation")
+	}
+	if _, err := VerifyOperationProof(proof); err != nil {
+		return OperationProof{}, err
+	}
+
+	return proof, nil
+}
+
+// Returns the events of the operations the miner confirmed to this key that come after the
+// event numbered since, oldest first.
+// Can return the following errors:
+// - DisconnectedError
+func (canvasObj CanvasObj) GetOperationEvents(since uint64) (events []OperationEvent, err error) {
+	err = canvasObj.MinerCli.Call("ArtKey.GetOperationEvents", since, &events)
+	if err != nil {
+		return nil, DisconnectedError(canvasObj.MinerAddress)
+	}
+
+	return events, nil
+}
+
+// Polls the canvas every interval for the operation events that come after the event numbered
+// since, and sends them on the returned channel. The channel is closed when the canvas is
+// disconnected.
+func SubscribeOperationEvents(canvas Canvas, since uint64, interval time.Duration) <-chan OperationEvent {
+	events := make(chan OperationEvent)
+
+	go func() {
+		defer close(events)
+
+		for {
+			newEvents, err := canvas.GetOperationEvents(since)
+			if err != nil {
+				return
+			}
+
+			for _, event := range newEvents {
+				events <- event
+				since = event.Seq
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+
+	return events
+}
+
 // Returns the amount of ink currently available.
 // Can return the following errors:
 // - DisconnectedError
@@ -490,7 +963,7 @@ func (canvasObj CanvasObj) DeleteShape(validateNum uint8, shapeHash string) (ink
 	address := canvasObj.MinerAddress
 	client := canvasObj.MinerCli
 
-	client.Call("ArtKey.DeleteShape", shapeHash, &inkRemaining)
+	err = client.Call("ArtKey.DeleteShape", shapeHash, &inkRemaining)
 	if err != nil {
 		if err.Error() == "Does not exist" || err.Error() == "Did not create" {
 			return 0, ShapeOwnerError(shapeHash)
@@ -498,8 +971,6 @@ func (canvasObj CanvasObj) DeleteShape(validateNum uint8, shapeHash string) (ink
 		return 0, DisconnectedError(address)
 	}
 
-	r, s, _ := ecdsa.Sign(rand.Reader, &canvasObj.PrivateKey, []byte("This is the private key!"))
-
 	var replyOp Operation
 	err = canvasObj.MinerCli.Call("ArtKey.GetOperationWithShapeHash", shapeHash, &replyOp)
 	if err != nil {
@@ -516,30 +987,26 @@ func (canvasObj CanvasObj) DeleteShape(validateNum uint8, shapeHash string) (ink
 
 	deleteOperation := Operation{
 		ArtNodeID:      canvasObj.ArtNodeID,
-		UniqueID:       r.String() + s.String(),
 		DeleteUniqueID: shapeHash,
 		ArtNodePubKey:  canvasObj.PrivateKey.PublicKey,
 		ValidateNum:    int(validateNum),
-		OPSigR:         r,
-		OPSigS:         s,
 		OpType:         "Delete",
 		Fill:           "white",
 		Stroke:         "white",
 		ShapeType:      shapeType,
 		ShapeSvgString: dString,
 		OpInkCost:      cost,
+		Expires:        time.Now().Add(OperationLifetime).UnixNano() / int64(time.Millisecond),
+	}
+	if err := SignOperation(&deleteOperation, canvasObj.PrivateKey); err != nil {
+		return 0, err
 	}
 
 	var reply bool
-	client.Call("ArtKey.ValidateDelete", deleteOperation, &reply)
+	err = client.Call("ArtKey.ValidateDelete", deleteOperation, &reply)
 
 	if err != nil {
-
-		if err.Error() == "connection is shut down" {
-			return 0, DisconnectedError(address)
-		} else {
-			return 0, err
-		}
+		return 0, decodeMinerError(err, address)
 	}
 
 	if reply {
@@ -567,47 +1034,708 @@ func (canvasObj CanvasObj) GetShapes(blockHash string) (shapeHashes []string, er
 	return shapeHashes, nil
 }
 
-///////////////////////////////// HELPER FUNCTIONS BELOW
+////////////////////////////////////////////////////////////////////////////////////////////
+// <VERIFYING CANVAS>
 
-// Retrieves all the PATH shapes from Ink Miner's local longest blockchain and creates an HTML file of the Canvas
-func CreateCanvasHTML(paths []string, version string, cSettings CanvasSettings) {
+// A Canvas that does not trust its miners. It downloads the block headers of their longest
+// chains and checks their linkage and proof of work from the genesis block of the trusted
+// settings, then checks the blocks and shapes the miners return against the verified headers.
+// AddShape, ReserveRegion, DeleteShape, GetInk, ShapeHistory and GetSessions go unchecked
+// through the first miner.
+type VerifyingCanvas struct {
+	CanvasObj
 
-	f, err := os.Create("Canvas" + version + ".html")
-	HandleError(err)
+	// Canvases on every miner that could be reached, the first one is the embedded CanvasObj
+	Miners   []CanvasObj
+	Settings MinerNetSettings
 
-	svgPath := "<svg height=\"" + strconv.Itoa(int(cSettings.CanvasYMax)) + "\" width=\"" + strconv.Itoa(int(cSettings.CanvasXMax)) + "\">"
+	headers *headerChain
+}
 
-	for i := 0; i < len(paths); i++ {
-		svgPath = svgPath + paths[i]
+// Headers verified by a VerifyingCanvas, starting at the genesis block.
+type headerChain struct {
+	sync.Mutex
+	settings MinerNetSettings
+	headers  map[string]*verifiedHeader
+	best     *verifiedHeader
+
+	// Shape hashes deleted by each block whose operations were checked against its header
+	deletes map[string][]string
+}
+
+// A header linked to the genesis block through verified headers.
+type verifiedHeader struct {
+	BlockHeader
+	Hash      string
+	Height    int
+	TotalWork *big.Int
+	parent    *verifiedHeader
+}
+
+// Opens a canvas on every miner in minerAddrs, and checks them against each other and against
+// settings, which have to come from a trusted source such as the server config (see
+// ReadNetSettings). Miners that can not be reached are left out.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidKeyError
+// - InvalidProofError
+func OpenVerifyingCanvas(minerAddrs []string, privKey ecdsa.PrivateKey, settings MinerNetSettings) (canvas Canvas, setting CanvasSettings, err error) {
+	genesisHash, err := GenesisHash(settings.Genesis)
+	if err != nil {
+		return nil, setting, err
+	}
+	if genesisHash != settings.GenesisBlockHash {
+		return nil, setting, InvalidProofError("genesis block hash does not match the genesis settings")
+	}
+
+	verifying := VerifyingCanvas{Settings: settings, headers: newHeaderChain(settings)}
+	for _, minerAddr := range minerAddrs {
+		minerCanvas, _, openErr := OpenCanvas(minerAddr, privKey)
+		if openErr != nil {
+			err = openErr
+			continue
+		}
+		verifying.Miners = append(verifying.Miners, minerCanvas.(CanvasObj))
+	}
+	if len(verifying.Miners) == 0 {
+		return nil, setting, err
+	}
+	verifying.CanvasObj = verifying.Miners[0]
+
+	if err := verifying.Sync(); err != nil {
+		verifying.CloseCanvas()
+		return nil, setting, err
 	}
-	svgPath = svgPath + "</svg>"
 
-	f.Write([]byte(svgPath))
+	canvasSettings = settings.CanvasSettings
+	return verifying, settings.CanvasSettings, nil
 }
 
-func ConstructSvgString(shapeType ShapeType, svgString string, fill string, stroke string) string {
-	// <path d="M 0 0 L 20 20" stroke="red" fill="transparent"/>
-	if shapeType == PATH {
-		return fmt.Sprintf("<path d=\"%s\" stroke=\"%s\" fill=\"%s\" />", svgString, stroke, fill)
+// Downloads and verifies the headers of the longest chain of every miner. The verified chain
+// with the most work is the longest chain of the canvas. Fails only if the headers of none of
+// the miners could be verified.
+func (canvas VerifyingCanvas) Sync() error {
+	var err error
+	synced := 0
+
+	for _, miner := range canvas.Miners {
+		if syncErr := canvas.headers.syncWith(miner); syncErr != nil {
+			err = syncErr
+			continue
+		}
+		synced++
 	}
 
-	return ""
+	if synced == 0 {
+		return err
+	}
+	return nil
 }
 
-// svg string can be at most 128 characters in string length
-func HandleSvgStringLength(svgstr string) bool {
-	if len(svgstr) > 128 {
-		return false
+// Closes the canvas on every miner. Returns the ink reported by the first miner.
+func (canvas VerifyingCanvas) CloseCanvas() (inkRemaining uint32, err error) {
+	for _, miner := range canvas.Miners[1:] {
+		miner.CloseCanvas()
 	}
-	return true
+
+	return canvas.CanvasObj.CloseCanvas()
 }
 
-// gets the corrdinates for the operation
-func GetCoordinates(svgArray []string) []Line {
-	// Uppercase = absolute
-	// Lowercase = relative
-	lines := []Line{}
-	origin := Point{}
+// Returns the genesis block hash of the trusted settings.
+func (canvas VerifyingCanvas) GetGenesisBlock() (blockHash string, err error) {
+	return canvas.Settings.GenesisBlockHash, nil
+}
+
+// Returns the shapes of a verified block, checked against the Merkle root of its header. Fails
+// with an InvalidProofError if every miner pruned operations of the block.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+// - InvalidProofError
+func (canvas VerifyingCanvas) GetShapes(blockHash string) (shapeHashes []string, err error) {
+	// the shapes of the genesis block come from the settings
+	if blockHash == canvas.Settings.GenesisBlockHash {
+		shapeHashes = []string{}
+		for i := range canvas.Settings.Genesis.Shapes {
+			shapeHashes = append(shapeHashes, blockHash+"-"+strconv.Itoa(i))
+		}
+		return shapeHashes, nil
+	}
+
+	header, err := canvas.verifiedHeader(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := canvas.verifiedOperations(header)
+	if err != nil {
+		return nil, err
+	}
+
+	shapeHashes = []string{}
+	for _, op := range operations {
+		shapeHashes = append(shapeHashes, op.UniqueID)
+	}
+	return shapeHashes, nil
+}
+
+// Returns the operations of the block from the first miner whose operations match the Merkle
+// root of the verified header and were not pruned. Only the fields of a pruned operation are
+// bound to the header, its signature can not be checked, so none of them is trusted.
+func (canvas VerifyingCanvas) verifiedOperations(header *verifiedHeader) (operations []Operation, err error) {
+	err = DisconnectedError(canvas.MinerAddress)
+	for _, miner := range canvas.Miners {
+		if callErr := miner.MinerCli.Call("ArtKey.GetBlockOperations", header.Hash, &operations); callErr != nil {
+			continue
+		}
+
+		if !bytes.Equal(MerkleRoot(operations), header.MerkleRoot) {
+			err = InvalidProofError("operations of block " + header.Hash + " do not match its header")
+			continue
+		}
+		if hasPrunedOperations(operations) {
+			err = InvalidProofError("operations of block " + header.Hash + " were pruned and can not be verified")
+			continue
+		}
+		return operations, nil
+	}
+
+	return nil, err
+}
+
+func hasPrunedOperations(operations []Operation) bool {
+	for _, op := range operations {
+		if op.Pruned {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a block of the verified longest chain, from the block with the hash on, deletes
+// the shape. Only the operations of blocks that have any are fetched, once per block. Fails with
+// an InvalidProofError if every miner pruned operations of one of those blocks.
+func (canvas VerifyingCanvas) isDeleted(shapeHash string, blockHash string) (bool, error) {
+	headers, onBestChain := canvas.headers.bestChainFrom(blockHash)
+	if !onBestChain {
+		return false, InvalidProofError("block " + blockHash + " is not on the verified longest chain")
+	}
+
+	emptyRoot := MerkleRoot(nil)
+	for _, header := range headers {
+		// the genesis block places shapes, it does not delete any
+		if header.Height == 1 || bytes.Equal(header.MerkleRoot, emptyRoot) {
+			continue
+		}
+
+		deletes, checked := canvas.headers.deletesOf(header.Hash)
+		if !checked {
+			operations, err := canvas.verifiedOperations(header)
+			if err != nil {
+				return false, err
+			}
+
+			deletes = []string{}
+			for _, op := range operations {
+				if op.OpType == "Delete" {
+					deletes = append(deletes, op.DeleteUniqueID)
+				}
+			}
+			canvas.headers.setDeletes(header.Hash, deletes)
+		}
+
+		for _, deleted := range deletes {
+			if deleted == shapeHash {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Returns the children of a verified block known to any of the miners, leaving out the ones
+// whose headers do not verify.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+// - InvalidProofError
+func (canvas VerifyingCanvas) GetChildren(blockHash string) (blockHashes []string, err error) {
+	if _, err := canvas.verifiedHeader(blockHash); err != nil {
+		return nil, err
+	}
+
+	blockHashes = []string{}
+	verified := make(map[string]bool)
+	connected := false
+
+	for _, miner := range canvas.Miners {
+		children, err := miner.GetChildren(blockHash)
+		if err != nil {
+			continue
+		}
+		connected = true
+
+		for _, child := range children {
+			if verified[child] {
+				continue
+			}
+
+			header, exists := canvas.headers.get(child)
+			if !exists {
+				var childHeader BlockHeader
+				if err := miner.MinerCli.Call("ArtKey.GetHeader", child, &childHeader); err != nil || childHeader.Hash() != child {
+					continue
+				}
+				if _, err := canvas.headers.add(childHeader); err != nil {
+					continue
+				}
+				header, _ = canvas.headers.get(child)
+			}
+
+			if header.PreviousHash != blockHash {
+				continue
+			}
+
+			verified[child] = true
+			blockHashes = append(blockHashes, child)
+		}
+	}
+
+	if !connected {
+		return nil, DisconnectedError(canvas.MinerAddress)
+	}
+	return blockHashes, nil
+}
+
+// Returns the hashes of the verified chain with the most work, after syncing with the miners.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidProofError
+func (canvas VerifyingCanvas) GetLongestChain() (blockHashes []string, err error) {
+	if err := canvas.Sync(); err != nil {
+		return nil, err
+	}
+
+	return canvas.headers.bestChain(), nil
+}
+
+// Returns the svg of a shape whose operation is proven to be in a block of the verified longest
+// chain, and that no later block of that chain deletes.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+// - InvalidProofError
+func (canvas VerifyingCanvas) GetSvgString(shapeHash string) (svgString string, err error) {
+	for i, shape := range canvas.Settings.Genesis.Shapes {
+		if shapeHash == canvas.Settings.GenesisBlockHash+"-"+strconv.Itoa(i) {
+			svgString = ConstructSvgString(PATH, shape.SvgString, shape.Fill, shape.Stroke)
+			return canvas.liveSvgString(shapeHash, canvas.Settings.GenesisBlockHash, svgString)
+		}
+	}
+
+	proof, err := canvas.GetOperationProof(shapeHash)
+	if err != nil {
+		return "", err
+	}
+
+	// reservations are not drawn on the canvas
+	op := proof.Operation
+	if op.OpType == "Reserve" {
+		return "", InvalidShapeHashError(shapeHash)
+	}
+
+	svgString = ConstructSvgString(op.ShapeType, op.ShapeSvgString, op.Fill, op.Stroke)
+	return canvas.liveSvgString(shapeHash, proof.Header.Hash(), svgString)
+}
+
+// Returns the svg string of the shape added in the block, or InvalidShapeHashError if the shape
+// was deleted since.
+func (canvas VerifyingCanvas) liveSvgString(shapeHash string, blockHash string, svgString string) (string, error) {
+	deleted, err := canvas.isDeleted(shapeHash, blockHash)
+	if err != nil {
+		return "", err
+	}
+	if deleted {
+		return "", InvalidShapeHashError(shapeHash)
+	}
+	return svgString, nil
+}
+
+// Returns a proof, from the first miner that has one, that the shape is in a block of the
+// verified longest chain.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+// - InvalidProofError
+func (canvas VerifyingCanvas) GetOperationProof(shapeHash string) (proof OperationProof, err error) {
+	err = DisconnectedError(canvas.MinerAddress)
+
+	for _, miner := range canvas.Miners {
+		minerProof, proofErr := miner.GetOperationProof(shapeHash)
+		if proofErr != nil {
+			if _, disconnected := proofErr.(DisconnectedError); !disconnected {
+				err = proofErr
+			}
+			continue
+		}
+
+		blockHash := minerProof.Header.Hash()
+		if !canvas.headers.onBestChain(blockHash) {
+			// the block may be newer than the headers we have
+			canvas.Sync()
+			if !canvas.headers.onBestChain(blockHash) {
+				err = InvalidProofError("block " + blockHash + " is not on the verified longest chain")
+				continue
+			}
+		}
+
+		return minerProof, nil
+	}
+
+	return OperationProof{}, err
+}
+
+// Returns the verified header of the block, syncing first if it is not known yet.
+func (canvas VerifyingCanvas) verifiedHeader(blockHash string) (*verifiedHeader, error) {
+	if header, exists := canvas.headers.get(blockHash); exists {
+		return header, nil
+	}
+
+	if err := canvas.Sync(); err != nil {
+		return nil, err
+	}
+
+	if header, exists := canvas.headers.get(blockHash); exists {
+		return header, nil
+	}
+	return nil, InvalidBlockHashError(blockHash)
+}
+
+func newHeaderChain(settings MinerNetSettings) *headerChain {
+	genesis := &verifiedHeader{
+		BlockHeader: BlockHeader{Version: BlockVersion, Target: DifficultyTarget(settings.PoWDifficultyNoOpBlock)},
+		Hash:        settings.GenesisBlockHash,
+		Height:      1,
+	}
+	genesis.TotalWork = TargetWork(BlockTarget(genesis.Target, len(settings.Genesis.Shapes) > 0, settings))
+
+	return &headerChain{
+		settings: settings,
+		headers:  map[string]*verifiedHeader{genesis.Hash: genesis},
+		best:     genesis,
+		deletes:  make(map[string][]string),
+	}
+}
+
+// Adds the headers of the miner's longest chain that follow the headers we have.
+func (chain *headerChain) syncWith(miner CanvasObj) error {
+	locator := chain.locator()
+
+	for {
+		var headers []BlockHeader
+		if err := miner.MinerCli.Call("ArtKey.GetHeaders", locator, &headers); err != nil {
+			return DisconnectedError(miner.MinerAddress)
+		}
+
+		added := 0
+		for _, header := range headers {
+			isNew, err := chain.add(header)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				added++
+			}
+		}
+
+		// the miner has no more headers, or only sends ones we have
+		if added == 0 {
+			return nil
+		}
+
+		// continue after the last header, which may be on a fork with less work than ours
+		locator = append([]string{headers[len(headers)-1].Hash()}, locator...)
+	}
+}
+
+// Checks the header against its parent the way miners check blocks, and adds it. Reports
+// whether the header is new.
+func (chain *headerChain) add(header BlockHeader) (bool, error) {
+	chain.Lock()
+	defer chain.Unlock()
+
+	hash := header.Hash()
+	if _, exists := chain.headers[hash]; exists {
+		return false, nil
+	}
+
+	parent, exists := chain.headers[header.PreviousHash]
+	if !exists {
+		return false, InvalidProofError("header " + hash + " does not follow a verified header")
+	}
+
+	if header.Version != BlockVersion {
+		return false, InvalidProofError("header " + hash + " has unknown version " + strconv.Itoa(int(header.Version)))
+	}
+
+	if header.Target == nil || header.Target.Cmp(chain.nextTarget(parent)) != 0 {
+		return false, InvalidProofError("header " + hash + " does not use the expected proof of work target")
+	}
+
+	isOpBlock := !bytes.Equal(header.MerkleRoot, MerkleRoot(nil))
+	target := BlockTarget(header.Target, isOpBlock, chain.settings)
+	if !HashMeetsTarget(hash, target) {
+		return false, InvalidProofError("header " + hash + " proof of work does not meet the target")
+	}
+
+	maxTimestamp := time.Now().Add(MaxFutureBlockTime).UnixNano() / int64(time.Millisecond)
+	if header.Timestamp <= chain.medianTimePast(parent) || header.Timestamp > maxTimestamp {
+		return false, InvalidProofError("header " + hash + " has an invalid timestamp")
+	}
+
+	verified := &verifiedHeader{
+		BlockHeader: header,
+		Hash:        hash,
+		Height:      parent.Height + 1,
+		TotalWork:   new(big.Int).Add(parent.TotalWork, TargetWork(target)),
+		parent:      parent,
+	}
+	chain.headers[hash] = verified
+
+	// as with miners, the first chain seen wins ties
+	if verified.TotalWork.Cmp(chain.best.TotalWork) > 0 {
+		chain.best = verified
+	}
+
+	return true, nil
+}
+
+func (chain *headerChain) get(hash string) (*verifiedHeader, bool) {
+	chain.Lock()
+	defer chain.Unlock()
+
+	header, exists := chain.headers[hash]
+	return header, exists
+}
+
+// Reports whether the block is on the verified chain with the most work.
+func (chain *headerChain) onBestChain(hash string) bool {
+	chain.Lock()
+	defer chain.Unlock()
+
+	header, exists := chain.headers[hash]
+	if !exists {
+		return false
+	}
+
+	ancestor := chain.best
+	for ancestor.Height > header.Height {
+		ancestor = ancestor.parent
+	}
+	return ancestor == header
+}
+
+// Returns the hashes of the best chain, starting with the genesis block.
+func (chain *headerChain) bestChain() []string {
+	chain.Lock()
+	defer chain.Unlock()
+
+	blockHashes := make([]string, chain.best.Height)
+	for header := chain.best; header != nil; header = header.parent {
+		blockHashes[header.Height-1] = header.Hash
+	}
+	return blockHashes
+}
+
+// Returns the headers of the best chain from the block with the hash to the tip, oldest first.
+// Reports false if the block is not on the best chain.
+func (chain *headerChain) bestChainFrom(hash string) ([]*verifiedHeader, bool) {
+	chain.Lock()
+	defer chain.Unlock()
+
+	headers := []*verifiedHeader{}
+	for header := chain.best; header != nil; header = header.parent {
+		headers = append(headers, header)
+		if header.Hash != hash {
+			continue
+		}
+
+		for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+			headers[i], headers[j] = headers[j], headers[i]
+		}
+		return headers, true
+	}
+	return nil, false
+}
+
+// Returns the shape hashes deleted by the block, if its operations were checked.
+func (chain *headerChain) deletesOf(hash string) ([]string, bool) {
+	chain.Lock()
+	defer chain.Unlock()
+
+	deletes, checked := chain.deletes[hash]
+	return deletes, checked
+}
+
+func (chain *headerChain) setDeletes(hash string, deletes []string) {
+	chain.Lock()
+	defer chain.Unlock()
+
+	chain.deletes[hash] = deletes
+}
+
+// Returns hashes of the best chain, newest first, spaced further apart the older they get.
+func (chain *headerChain) locator() []string {
+	chain.Lock()
+	defer chain.Unlock()
+
+	locator := []string{}
+	header := chain.best
+
+	step := 1
+	for header.parent != nil {
+		locator = append(locator, header.Hash)
+		if len(locator) >= 10 {
+			step = step * 2
+		}
+		for i := 0; i < step && header.parent != nil; i++ {
+			header = header.parent
+		}
+	}
+
+	return append(locator, header.Hash)
+}
+
+// Returns the base target children of parent have to carry, as miners compute it. The caller
+// holds the lock.
+func (chain *headerChain) nextTarget(parent *verifiedHeader) *big.Int {
+	window := int(chain.settings.RetargetWindow)
+	if chain.settings.TargetBlockInterval == 0 || window == 0 || parent.Height%window != 0 {
+		return parent.Target
+	}
+
+	first := parent
+	for i := 0; i < window; i++ {
+		// the genesis block has no timestamp, the first window after it keeps its target
+		if first.parent == nil || first.parent.parent == nil {
+			return parent.Target
+		}
+		first = first.parent
+	}
+
+	return RetargetBase(parent.Target, parent.Timestamp-first.Timestamp, chain.settings)
+}
+
+// Returns the median timestamp of the header and the MedianTimeBlocks - 1 headers before it.
+// The caller holds the lock.
+func (chain *headerChain) medianTimePast(header *verifiedHeader) int64 {
+	timestamps := []int64{}
+	for ; header != nil && len(timestamps) < MedianTimeBlocks; header = header.parent {
+		timestamps = append(timestamps, header.Timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// </VERIFYING CANVAS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+///////////////////////////////// HELPER FUNCTIONS BELOW
+
+// Errors returned by the miner arrive as plain strings, so the InvalidKeyError is matched by its message.
+func isInvalidKeyError(err error) bool {
+	return strings.HasPrefix(err.Error(), "BlockArt: Public Key is not validated")
+}
+
+// Errors returned by the miner arrive as rpc.ServerError strings. Turns the ones produced by the
+// error types of this package back into those types; any failure of the connection itself
+// becomes a DisconnectedError.
+func decodeMinerError(err error, minerAddr string) error {
+	if _, ok := err.(rpc.ServerError); !ok {
+		return DisconnectedError(minerAddr)
+	}
+
+	msg := err.Error()
+	arg := ""
+	if start, end := strings.LastIndex(msg, "["), strings.LastIndex(msg, "]"); start >= 0 && end > start {
+		arg = msg[start+1 : end]
+	}
+
+	switch {
+	case strings.HasPrefix(msg, "BlockArt: Not enough ink"):
+		ink, _ := strconv.ParseUint(arg, 10, 32)
+		return InsufficientInkError(ink)
+	case strings.HasPrefix(msg, "BlockArt: Bad shape svg string"):
+		return InvalidShapeSvgStringError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Shape svg string too long"):
+		return ShapeSvgStringTooLongError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Invalid shape hash"):
+		return InvalidShapeHashError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Shape owned by someone else"):
+		return ShapeOwnerError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Shape is outside the bounds"):
+		return OutOfBoundsError{}
+	case strings.HasPrefix(msg, "BlockArt: Shape overlaps"):
+		return ShapeOverlapError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Invalid block hash"):
+		return InvalidBlockHashError(arg)
+	case isInvalidKeyError(err):
+		return InvalidKeyError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Session limit reached"):
+		return SessionLimitError(arg)
+	case strings.HasPrefix(msg, "BlockArt: Region is reserved"):
+		return RegionReservedError(arg)
+	}
+
+	return err
+}
+
+// Retrieves all the PATH shapes from Ink Miner's local longest blockchain and creates an HTML file of the Canvas
+func CreateCanvasHTML(paths []string, version string, cSettings CanvasSettings) {
+
+	f, err := os.Create("Canvas" + version + ".html")
+	HandleError(err)
+
+	f.Write([]byte(ConstructCanvasSvg(paths, cSettings)))
+}
+
+// Wraps the PATH shapes in an svg element with the dimensions of the canvas.
+func ConstructCanvasSvg(paths []string, cSettings CanvasSettings) string {
+	svgPath := "<svg height=\"" + strconv.Itoa(int(cSettings.CanvasYMax)) + "\" width=\"" + strconv.Itoa(int(cSettings.CanvasXMax)) + "\">"
+
+	for i := 0; i < len(paths); i++ {
+		svgPath = svgPath + paths[i]
+	}
+	svgPath = svgPath + "</svg>"
+
+	return svgPath
+}
+
+func ConstructSvgString(shapeType ShapeType, svgString string, fill string, stroke string) string {
+	// <path d="M 0 0 L 20 20" stroke="red" fill="transparent"/>
+	if shapeType == PATH {
+		return fmt.Sprintf("<path d=\"%s\" stroke=\"%s\" fill=\"%s\" />", svgString, stroke, fill)
+	}
+
+	return ""
+}
+
+// svg string can be at most 128 characters in string length
+func HandleSvgStringLength(svgstr string) bool {
+	if len(svgstr) > 128 {
+		return false
+	}
+	return true
+}
+
+// gets the corrdinates for the operation
+func GetCoordinates(svgArray []string) []Line {
+	// Uppercase = absolute
+	// Lowercase = relative
+	lines := []Line{}
+	origin := Point{}
 	startPt := Point{}
 	endPt := Point{}
 
@@ -732,6 +1860,16 @@ func CalcInkUsed(lines []Line, fill string) uint32 {
 
 }
 
+// Ink needed to reserve the region for numBlocks blocks (at least 1).
+func CalcReserveInk(region Rect, numBlocks uint32) uint32 {
+	area := (region.MaxX - region.MinX) * (region.MaxY - region.MinY)
+	ink := uint32(math.Ceil(area * float64(numBlocks) / ReserveAreaPerInk))
+	if ink == 0 {
+		return 1
+	}
+	return ink
+}
+
 func PolygonArea(points []Point) float64 {
 	first := points[0]
 	last := first
@@ -842,8 +1980,37 @@ func isNum(svgNum string) bool {
 	return true
 }
 
-// checks the boundary settings for the position of shape, EX "M 0 10 H 20" checks 0 and 10
+// Parses the svg path of a shape the way AddShape does, and returns its lines and the ink it uses.
+// Miners use it to check the shapes they receive.
+// Can return the following errors:
+// - ShapeSvgStringTooLongError
+// - InvalidShapeSvgStringError
+// - OutOfBoundsError
+func ParseShape(shapeSvgString string, fill string, stroke string, cSettings CanvasSettings) ([]Line, uint32, error) {
+	if !HandleSvgStringLength(shapeSvgString) {
+		return nil, 0, ShapeSvgStringTooLongError(shapeSvgString)
+	}
+
+	svgArray := strings.Split(shapeSvgString, " ")
+
+	if !checkValidFillAndStroke(fill, stroke) || !checkValidSvgArray(svgArray) {
+		return nil, 0, InvalidShapeSvgStringError(shapeSvgString)
+	}
+
+	lines := GetCoordinates(svgArray)
+	if !boundCheckIn(lines, cSettings) {
+		return nil, 0, OutOfBoundsError{}
+	}
+
+	return lines, CalcInkUsed(lines, fill), nil
+}
+
+// Checks that the lines are on the canvas opened with OpenCanvas.
 func BoundCheck(lines []Line) bool {
+	return boundCheckIn(lines, canvasSettings)
+}
+
+func boundCheckIn(lines []Line, canvasSettings CanvasSettings) bool {
 	for i := 0; i < len(lines); i++ {
 		xstart := lines[i].Start
 		xspos := xstart.X
@@ -882,41 +2049,15 @@ func BoundCheck(lines []Line) bool {
 	return true
 }
 
-func FindPaths(canvas Canvas, blockHash string, path []string, res *[][]string) error {
-
-	children, err := canvas.GetChildren(blockHash)
-	HandleError(err)
-	if len(children) == 0 {
-		*res = append(*res, path)
-		return nil
-	} else {
-		pathTemp := path
-		for _, c := range children {
-			pathTemp = append(path, c)
-			FindPaths(canvas, c, pathTemp, res)
-		}
-	}
-	return err
+// Returns the hashes of the blocks on the chain with the most work, starting with the genesis
+// block (see Canvas.GetLongestChain).
+func GetLongestChain(canvas Canvas) ([]string, error) {
+	return canvas.GetLongestChain()
 }
 
 func GetAllSVGs(canvas Canvas) ([]string, error) {
-	res := [][]string{}
-	var resPtr *[][]string
-	resPtr = &res
-	path := []string{}
-
-	genHash, err := canvas.GetGenesisBlock()
-	HandleError(err)
-
-	// fills resPtr with arrays of all paths
-	findPathError := FindPaths(canvas, genHash, path, resPtr)
-
-	longestPath := []string{}
-	for _, tempPath := range res {
-		if len(tempPath) > len(longestPath) {
-			longestPath = tempPath
-		}
-	}
+	longestPath, findPathError := GetLongestChain(canvas)
+	HandleError(findPathError)
 
 	shapeHashes := []string{}
 	for _, blockHash := range longestPath {
@@ -928,12 +2069,483 @@ func GetAllSVGs(canvas Canvas) ([]string, error) {
 	SVGs := []string{}
 	for _, sHash := range shapeHashes {
 		currSVG, err := canvas.GetSvgString(sHash)
+		if _, ok := err.(InvalidShapeHashError); ok {
+			continue
+		}
 		HandleError(err)
 		SVGs = append(SVGs, currSVG)
 	}
 	return SVGs, findPathError
 }
 
+// Returns the target that is as hard to meet as a hash ending in the given number of hex zeroes.
+func DifficultyTarget(zeroes uint8) *big.Int {
+	target := new(big.Int).Rsh(new(big.Int).Add(MaxTarget, big.NewInt(1)), 4*uint(zeroes))
+	return target.Sub(target, big.NewInt(1))
+}
+
+// Returns the target of a block given the base target of the chain: the base target for No-Op
+// blocks, and the base target scaled by the ratio of the configured difficulties for Op blocks.
+func BlockTarget(baseTarget *big.Int, isOpBlock bool, settings MinerNetSettings) *big.Int {
+	if !isOpBlock {
+		return baseTarget
+	}
+
+	target := new(big.Int).Add(baseTarget, big.NewInt(1))
+	target.Mul(target, new(big.Int).Add(DifficultyTarget(settings.PoWDifficultyOpBlock), big.NewInt(1)))
+	target.Div(target, new(big.Int).Add(DifficultyTarget(settings.PoWDifficultyNoOpBlock), big.NewInt(1)))
+	target.Sub(target, big.NewInt(1))
+
+	return clampTarget(target)
+}
+
+// Adjusts the base target so that blocks take TargetBlockInterval: timespan is the number of
+// milliseconds the last RetargetWindow blocks took.
+func RetargetBase(baseTarget *big.Int, timespan int64, settings MinerNetSettings) *big.Int {
+	expected := int64(settings.TargetBlockInterval) * int64(settings.RetargetWindow)
+	if timespan < expected/MaxRetargetFactor {
+		timespan = expected / MaxRetargetFactor
+	} else if timespan > expected*MaxRetargetFactor {
+		timespan = expected * MaxRetargetFactor
+	}
+
+	target := new(big.Int).Mul(baseTarget, big.NewInt(timespan))
+	target.Div(target, big.NewInt(expected))
+
+	return clampTarget(target)
+}
+
+// Reports whether the hex encoded hash is at most target.
+func HashMeetsTarget(hash string, target *big.Int) bool {
+	value, ok := new(big.Int).SetString(hash, 16)
+	return ok && target != nil && value.Cmp(target) <= 0
+}
+
+// Returns the expected number of hashes needed to find one that meets target.
+func TargetWork(target *big.Int) *big.Int {
+	space := new(big.Int).Add(MaxTarget, big.NewInt(1))
+	return space.Div(space, new(big.Int).Add(target, big.NewInt(1)))
+}
+
+func clampTarget(target *big.Int) *big.Int {
+	if target.Sign() <= 0 {
+		return big.NewInt(1)
+	}
+	if target.Cmp(MaxTarget) > 0 {
+		return new(big.Int).Set(MaxTarget)
+	}
+	return target
+}
+
+// Returns the hex encoded SHA-256 hash of the canonical encoding of the header.
+func (header BlockHeader) Hash() string {
+	h := sha256.New()
+	writeUint(h, uint64(header.Version))
+	writeString(h, header.PreviousHash)
+	writeBytes(h, header.MerkleRoot)
+	writePubKey(h, header.MinerPubKey)
+	writeUint(h, uint64(header.Nonce))
+	writeUint(h, header.ExtraNonce)
+	writeInt(h, header.Timestamp)
+	if header.Target != nil {
+		writeBytes(h, header.Target.Bytes())
+	} else {
+		writeBytes(h, nil)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the leaf of the operation in the Merkle tree of its block: the SHA-256 digest of the
+// fields a miner keeps when it prunes the operation, and of the digest of its body (see
+// OperationBodyHash).
+func OperationLeaf(op Operation) []byte {
+	return operationLeaf(op, OperationBodyHash(op))
+}
+
+// Returns the SHA-256 digest of the signed digest and the signature of the operation.
+func OperationBodyHash(op Operation) []byte {
+	h := sha256.New()
+	writeBytes(h, OperationDigest(op))
+	writeBigInt(h, op.OPSigR)
+	writeBigInt(h, op.OPSigS)
+	return h.Sum(nil)
+}
+
+// Returns the leaf of the operation in the Merkle tree of its block. The body of a pruned
+// operation is gone, so its leaf is recomputed from the digest of the body it carries; every
+// field that is applied to the chain state is still bound to the Merkle root of the block.
+func MerkleLeaf(op Operation) []byte {
+	if op.Pruned {
+		return operationLeaf(op, op.BodyHash)
+	}
+	return OperationLeaf(op)
+}
+
+func operationLeaf(op Operation, bodyHash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	writeBytes(h, bodyHash)
+	writeString(h, op.UniqueID)
+	writeString(h, op.OpType)
+	writeInt(h, int64(op.ShapeType))
+	writeInt(h, int64(op.ArtNodeID))
+	writePubKey(h, op.ArtNodePubKey)
+	writeUint(h, uint64(op.OpInkCost))
+	writeString(h, op.DeleteUniqueID)
+	writeFloat(h, op.Region.MinX)
+	writeFloat(h, op.Region.MinY)
+	writeFloat(h, op.Region.MaxX)
+	writeFloat(h, op.Region.MaxY)
+	writeInt(h, int64(op.ReserveBlocks))
+	writeInt(h, op.Expires)
+	return h.Sum(nil)
+}
+
+// Returns the root of the Merkle tree over the leaves of the operations, in order. A node without
+// a sibling moves up a level unchanged. The root of no operations is the SHA-256 digest of nothing.
+func MerkleRoot(ops []Operation) []byte {
+	if len(ops) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+
+	level := merkleLeaves(ops)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+// Returns the branch from the leaf of ops[index] to the Merkle root of ops.
+func MerkleBranch(ops []Operation, index int) []MerkleStep {
+	branch := []MerkleStep{}
+
+	level := merkleLeaves(ops)
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			branch = append(branch, MerkleStep{Hash: level[sibling], Left: sibling < index})
+		}
+		level = merkleLevel(level)
+		index /= 2
+	}
+
+	return branch
+}
+
+// Reports whether the branch leads from the leaf to the root.
+func VerifyMerkleBranch(leaf []byte, branch []MerkleStep, root []byte) bool {
+	hash := leaf
+	for _, step := range branch {
+		if step.Left {
+			hash = merkleParent(step.Hash, hash)
+		} else {
+			hash = merkleParent(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
+
+func merkleLeaves(ops []Operation) [][]byte {
+	leaves := make([][]byte, len(ops))
+	for i, op := range ops {
+		leaves[i] = MerkleLeaf(op)
+	}
+	return leaves
+}
+
+func merkleLevel(level [][]byte) [][]byte {
+	next := [][]byte{}
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleParent(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+// Leaves and inner nodes are hashed with different prefixes, so a leaf can not pass for a node.
+func merkleParent(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Checks that the operation is signed by its art node, that the branch of the proof leads from
+// it to the Merkle root of the header, and that the hash of the header meets the target in it.
+// Returns the hash of the block. Whether the block is on the longest chain is not checked.
+func VerifyOperationProof(proof OperationProof) (blockHash string, err error) {
+	if !VerifyOperation(proof.Operation) {
+		return "", InvalidProofError("operation signature does not verify")
+	}
+
+	if !VerifyMerkleBranch(OperationLeaf(proof.Operation), proof.Branch, proof.Header.MerkleRoot) {
+		return "", InvalidProofError("operation is not in the block")
+	}
+
+	if proof.Header.Version != BlockVersion {
+		return "", InvalidProofError("unknown block version " + strconv.Itoa(int(proof.Header.Version)))
+	}
+
+	blockHash = proof.Header.Hash()
+	if !HashMeetsTarget(blockHash, proof.Header.Target) {
+		return "", InvalidProofError("block proof of work does not meet its target")
+	}
+
+	return blockHash, nil
+}
+
+// Returns the SHA-256 digest art nodes sign for an operation. It covers every field of the
+// operation except the signature, the UniqueID derived from it and the fields derived from
+// the svg string (Lines and PathShape).
+func OperationDigest(op Operation) []byte {
+	h := sha256.New()
+	writeString(h, op.OpType)
+	writeInt(h, int64(op.ShapeType))
+	writeInt(h, int64(op.ArtNodeID))
+	writePubKey(h, op.ArtNodePubKey)
+	writeInt(h, int64(op.ValidateNum))
+	writeString(h, op.ShapeSvgString)
+	writeString(h, op.Fill)
+	writeString(h, op.Stroke)
+	writeUint(h, uint64(op.OpInkCost))
+	writeString(h, op.DeleteUniqueID)
+	writeFloat(h, op.Region.MinX)
+	writeFloat(h, op.Region.MinY)
+	writeFloat(h, op.Region.MaxX)
+	writeFloat(h, op.Region.MaxY)
+	writeInt(h, int64(op.ReserveBlocks))
+	writeInt(h, op.Expires)
+	return h.Sum(nil)
+}
+
+// Returns the key with its curve set to KeyCurve, or false if it is not a point of KeyCurve. Keys
+// decoded from gob carry their curve as bare CurveParams, so the curve is compared by its
+// parameters, and signatures are then checked on KeyCurve itself.
+func CheckPublicKey(key ecdsa.PublicKey) (ecdsa.PublicKey, bool) {
+	if key.Curve == nil || key.X == nil || key.Y == nil {
+		return key, false
+	}
+
+	params, expected := key.Curve.Params(), KeyCurve.Params()
+	if params == nil || params.BitSize != expected.BitSize {
+		return key, false
+	}
+	for _, pair := range [][2]*big.Int{{params.P, expected.P}, {params.N, expected.N}, {params.B, expected.B}, {params.Gx, expected.Gx}, {params.Gy, expected.Gy}} {
+		if pair[0] == nil || pair[0].Cmp(pair[1]) != 0 {
+			return key, false
+		}
+	}
+
+	if !KeyCurve.IsOnCurve(key.X, key.Y) {
+		return key, false
+	}
+	key.Curve = KeyCurve
+	return key, true
+}
+
+// Signs the digest of the operation and sets its UniqueID, which is the shape hash. The
+// signature is normalized to the low S form that VerifyOperation requires.
+func SignOperation(op *Operation, privKey ecdsa.PrivateKey) error {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, OperationDigest(*op))
+	if err != nil {
+		return err
+	}
+
+	if n := privKey.Curve.Params().N; s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s = new(big.Int).Sub(n, s)
+	}
+
+	op.OPSigR = r
+	op.OPSigS = s
+	op.UniqueID = r.String() + s.String()
+	return nil
+}
+
+// Reports whether the operation is signed by ArtNodePubKey, a key on KeyCurve, and its UniqueID
+// matches the signature. Only low S signatures are accepted: (R, N - S) is just as valid as (R, S), and would otherwise
+// let anyone replay an operation under a new UniqueID.
+func VerifyOperation(op Operation) bool {
+	pubKey, valid := CheckPublicKey(op.ArtNodePubKey)
+	if !valid || op.OPSigR == nil || op.OPSigS == nil {
+		return false
+	}
+	if op.UniqueID != op.OPSigR.String()+op.OPSigS.String() {
+		return false
+	}
+	if op.OPSigS.Cmp(new(big.Int).Rsh(KeyCurve.Params().N, 1)) > 0 {
+		return false
+	}
+	return ecdsa.Verify(&pubKey, OperationDigest(op), op.OPSigR, op.OPSigS)
+}
+
+// Canonical encoding the digests are computed over: integers are 8 byte big-endian, floats are
+// their IEEE 754 bits, byte strings are prefixed with their length.
+func writeUint(w io.Writer, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	w.Write(buf[:])
+}
+
+func writeInt(w io.Writer, v int64) {
+	writeUint(w, uint64(v))
+}
+
+func writeFloat(w io.Writer, f float64) {
+	writeUint(w, math.Float64bits(f))
+}
+
+func writeBytes(w io.Writer, b []byte) {
+	writeUint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+func writeString(w io.Writer, s string) {
+	writeBytes(w, []byte(s))
+}
+
+func writeBigInt(w io.Writer, v *big.Int) {
+	if v == nil {
+		writeBytes(w, nil)
+		return
+	}
+	writeBytes(w, v.Bytes())
+}
+
+func writePubKey(w io.Writer, key ecdsa.PublicKey) {
+	if key.Curve == nil || key.X == nil || key.Y == nil {
+		writeBytes(w, nil)
+		return
+	}
+	writeBytes(w, elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// Reads the miner settings of the network ("miner-settings") from the server config, to open a
+// VerifyingCanvas with.
+func ReadNetSettings(path string) (MinerNetSettings, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return MinerNetSettings{}, err
+	}
+	defer file.Close()
+
+	var config struct {
+		MinerSettings MinerNetSettings `json:"miner-settings"`
+	}
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return MinerNetSettings{}, err
+	}
+
+	return config.MinerSettings, nil
+}
+
+// Returns the hash of the genesis block with the given contents. The genesis block has no
+// header, its hash is the SHA-256 digest of a description of the allocations and shapes.
+func GenesisHash(genesis GenesisSettings) (string, error) {
+	h := sha256.New()
+	h.Write([]byte("BlockArt genesis\n"))
+
+	for _, allocation := range genesis.Allocations {
+		key, err := ParsePublicKey(allocation.PubKey)
+		if err != nil {
+			return "", errors.New("Bad key in genesis allocation: " + err.Error())
+		}
+		h.Write([]byte("ink " + hex.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y)) + " " + strconv.Itoa(int(allocation.Ink)) + "\n"))
+	}
+
+	for _, shape := range genesis.Shapes {
+		key, err := ParsePublicKey(shape.PubKey)
+		if err != nil {
+			return "", errors.New("Bad key in genesis shape: " + err.Error())
+		}
+		h.Write([]byte("shape " + hex.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y)) + " " + shape.SvgString + " " + shape.Fill + " " + shape.Stroke + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Reads a chain exported by "ink-miner export".
+func ReadChainExport(path string) (ChainExport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ChainExport{}, err
+	}
+	defer file.Close()
+
+	return DecodeChainExport(file)
+}
+
+// Decodes an exported chain and checks its version and that every block follows its parent.
+func DecodeChainExport(reader io.Reader) (ChainExport, error) {
+	var chain ChainExport
+	if err := json.NewDecoder(reader).Decode(&chain); err != nil {
+		return ChainExport{}, err
+	}
+
+	if chain.Version != ChainExportVersion {
+		return ChainExport{}, fmt.Errorf("unsupported chain export version %d", chain.Version)
+	}
+
+	heights := map[string]int{chain.GenesisBlockHash: 1}
+	for _, block := range chain.Blocks {
+		parentHeight, exists := heights[block.PreviousHash]
+		if !exists {
+			return ChainExport{}, errors.New("block " + block.Hash + " comes before its parent " + block.PreviousHash)
+		}
+		if block.Height != parentHeight+1 {
+			return ChainExport{}, errors.New("block " + block.Hash + " has the wrong height")
+		}
+		heights[block.Hash] = block.Height
+	}
+
+	return chain, nil
+}
+
+// Encodes a public key the way the chain export and generate-key-pair.go do.
+func EncodePublicKey(key ecdsa.PublicKey) string {
+	keyBytes, err := x509.MarshalPKIXPublicKey(&key)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(keyBytes)
+}
+
+// Decodes a hex encoded PKIX public key.
+func ParsePublicKey(encoded string) (ecdsa.PublicKey, error) {
+	keyBytes, err := hex.DecodeString(encoded)
+	if err != nil {
+		return ecdsa.PublicKey{}, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return ecdsa.PublicKey{}, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return ecdsa.PublicKey{}, errors.New("not an ECDSA public key")
+	}
+	return *ecdsaKey, nil
+}
+
+// Returns the signature of an exported operation.
+func (op ExportedOperation) Signature() (r *big.Int, s *big.Int, err error) {
+	r, ok := new(big.Int).SetString(op.SignatureR, 16)
+	if !ok {
+		return nil, nil, errors.New("bad signature of operation " + op.UniqueID)
+	}
+	s, ok = new(big.Int).SetString(op.SignatureS, 16)
+	if !ok {
+		return nil, nil, errors.New("bad signature of operation " + op.UniqueID)
+	}
+	return r, s, nil
+}
+
 func HandleError(err error) {
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,217 @@
+package blockartlib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+)
+
+func TestSignOperationUsesLowS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	halfN := new(big.Int).Rsh(key.Curve.Params().N, 1)
+
+	// about half of the raw signatures have a high S
+	for i := 0; i < 32; i++ {
+		op := Operation{ArtNodePubKey: key.PublicKey, OpType: "Delete", DeleteUniqueID: "shape"}
+		if err := SignOperation(&op, *key); err != nil {
+			t.Fatal(err)
+		}
+
+		if op.OPSigS.Cmp(halfN) > 0 {
+			t.Fatal("SignOperation returned a high S signature")
+		}
+		if !VerifyOperation(op) {
+			t.Fatal("signed operation does not verify")
+		}
+	}
+}
+
+func TestPrunedOperationKeepsItsLeaf(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{ArtNodePubKey: key.PublicKey, OpType: "Add", ShapeSvgString: "M 0 0 h 10", OpInkCost: 10}
+	if err := SignOperation(&op, *key); err != nil {
+		t.Fatal(err)
+	}
+
+	// what a pruning miner keeps of the operation
+	pruned := Operation{
+		UniqueID:      op.UniqueID,
+		ArtNodePubKey: op.ArtNodePubKey,
+		OpType:        op.OpType,
+		OpInkCost:     op.OpInkCost,
+		Pruned:        true,
+		BodyHash:      OperationBodyHash(op),
+	}
+	if !bytes.Equal(MerkleLeaf(pruned), OperationLeaf(op)) {
+		t.Fatal("pruned operation has another leaf")
+	}
+
+	pruned.OpInkCost = 0
+	if bytes.Equal(MerkleLeaf(pruned), OperationLeaf(op)) {
+		t.Error("leaf of the pruned operation does not cover its ink cost")
+	}
+}
+
+func TestVerifyOperationRequiresP384Key(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{ArtNodePubKey: key.PublicKey, OpType: "Delete", DeleteUniqueID: "shape"}
+	if err := SignOperation(&op, *key); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys decoded from gob carry the curve as bare CurveParams
+	params := *elliptic.P384().Params()
+	decoded := op
+	decoded.ArtNodePubKey.Curve = &params
+	if !VerifyOperation(decoded) {
+		t.Error("operation of a P-384 key with the curve as CurveParams does not verify")
+	}
+
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Operation{ArtNodePubKey: p256.PublicKey, OpType: "Delete", DeleteUniqueID: "shape"}
+	if err := SignOperation(&other, *p256); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, curve := range map[string]elliptic.Curve{"no curve": nil, "empty curve": &elliptic.CurveParams{}} {
+		forged := op
+		forged.ArtNodePubKey.Curve = curve
+		if VerifyOperation(forged) {
+			t.Errorf("%s: operation verifies", name)
+		}
+	}
+	if VerifyOperation(other) {
+		t.Error("operation of a P-256 key verifies")
+	}
+}
+
+// Serves the operations of blocks the way ArtKey.GetBlockOperations does on a miner.
+type testMiner struct {
+	operations map[string][]Operation
+}
+
+func (miner *testMiner) GetBlockOperations(blockHash string, operations *[]Operation) error {
+	*operations = miner.operations[blockHash]
+	return nil
+}
+
+// Returns a canvas on a miner serving the operations, over JSON, since gob can not encode the
+// curves of the keys in operations that are not pruned.
+func newTestVerifyingCanvas(t *testing.T, settings MinerNetSettings, miner *testMiner) VerifyingCanvas {
+	server := rpc.NewServer()
+	if err := server.RegisterName("ArtKey", miner); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+
+	cli := rpc.NewClientWithCodec(jsonrpc.NewClientCodec(clientConn))
+	t.Cleanup(func() { cli.Close() })
+
+	minerCanvas := CanvasObj{MinerAddress: "test", MinerCli: cli}
+	return VerifyingCanvas{CanvasObj: minerCanvas, Miners: []CanvasObj{minerCanvas}, Settings: settings, headers: newHeaderChain(settings)}
+}
+
+func TestVerifyingCanvasLeavesOutDeletedShapes(t *testing.T) {
+	settings := MinerNetSettings{
+		GenesisBlockHash: "genesis",
+		Genesis: GenesisSettings{Shapes: []GenesisShape{
+			{SvgString: "M 0 0 h 10", Fill: "transparent", Stroke: "red"},
+			{SvgString: "M 0 20 h 10", Fill: "transparent", Stroke: "red"},
+		}},
+	}
+
+	// the block after the genesis block deletes its first shape
+	deleteOp := Operation{OpType: "Delete", UniqueID: "delete", DeleteUniqueID: "genesis-0"}
+	miner := &testMiner{operations: map[string][]Operation{"block": {deleteOp}}}
+	canvas := newTestVerifyingCanvas(t, settings, miner)
+
+	genesis := canvas.headers.best
+	block := &verifiedHeader{
+		BlockHeader: BlockHeader{PreviousHash: genesis.Hash, MerkleRoot: MerkleRoot([]Operation{deleteOp})},
+		Hash:        "block",
+		Height:      2,
+		TotalWork:   new(big.Int).Add(genesis.TotalWork, big.NewInt(1)),
+		parent:      genesis,
+	}
+	canvas.headers.headers[block.Hash] = block
+	canvas.headers.best = block
+
+	if _, err := canvas.GetSvgString("genesis-0"); err == nil {
+		t.Error("deleted shape has an svg string")
+	} else if _, invalid := err.(InvalidShapeHashError); !invalid {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	svgString, err := canvas.GetSvgString("genesis-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := ConstructSvgString(PATH, "M 0 20 h 10", "transparent", "red"); svgString != expected {
+		t.Errorf("svg string is %s, expected %s", svgString, expected)
+	}
+
+	// operations that do not match the header are not trusted
+	miner.operations["block"] = []Operation{}
+	canvas.headers.deletes = make(map[string][]string)
+	if _, err := canvas.GetSvgString("genesis-1"); err == nil {
+		t.Error("operations that do not match the header were trusted")
+	}
+}
+
+func TestVerifyingCanvasDoesNotTrustPrunedOperations(t *testing.T) {
+	settings := MinerNetSettings{
+		GenesisBlockHash: "genesis",
+		Genesis:          GenesisSettings{Shapes: []GenesisShape{{SvgString: "M 0 0 h 10", Fill: "transparent", Stroke: "red"}}},
+	}
+
+	// the miner pruned the operations of the block after the genesis block; they match its header
+	pruned := []Operation{
+		{OpType: "Delete", UniqueID: "delete", DeleteUniqueID: "genesis-0", Pruned: true, BodyHash: []byte("body of the delete")},
+		{OpType: "Add", UniqueID: "shape", Pruned: true, BodyHash: []byte("body of the shape")},
+	}
+	miner := &testMiner{operations: map[string][]Operation{"block": pruned}}
+	canvas := newTestVerifyingCanvas(t, settings, miner)
+
+	genesis := canvas.headers.best
+	block := &verifiedHeader{
+		BlockHeader: BlockHeader{PreviousHash: genesis.Hash, MerkleRoot: MerkleRoot(pruned)},
+		Hash:        "block",
+		Height:      2,
+		TotalWork:   new(big.Int).Add(genesis.TotalWork, big.NewInt(1)),
+		parent:      genesis,
+	}
+	canvas.headers.headers[block.Hash] = block
+	canvas.headers.best = block
+
+	if shapes, err := canvas.GetShapes("block"); err == nil {
+		t.Errorf("shapes of a pruned block are %v", shapes)
+	} else if _, invalid := err.(InvalidProofError); !invalid {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// whether the pruned block deletes the genesis shape can not be verified
+	if _, err := canvas.GetSvgString("genesis-0"); err == nil {
+		t.Error("shape that a pruned block may delete has an svg string")
+	} else if _, invalid := err.(InvalidProofError); !invalid {
+		t.Errorf("unexpected error %v", err)
+	}
+}
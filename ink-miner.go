@@ -3,9 +3,18 @@
 Ink Miner.
 
 Usage:
-go run ink-miner.go [server ip:port] [pubKey] [privKey]
+go run ink-miner.go [server ip:port] [pubKey] [privKey] [listen ip:port] [public ip:port] [data dir] [workers]
 server ip:port: server IP addr
 pubKey + privKey: key pair to validate connecting art nodes
+listen ip:port: address to accept miners and art nodes on
+public ip:port: address other miners use to reach this miner
+data dir: directory the blockchain is stored in (optional, default "inkminer-data-[listen port]")
+workers: number of goroutines mining blocks (optional, default the number of CPUs)
+
+go run ink-miner.go export -data-dir [data dir] [-out chain.json]
+go run ink-miner.go import -data-dir [data dir] -in chain.json
+Export writes the stored blockchain as JSON (see blockartlib.ChainExport), import adds the
+blocks of such a file to the stored blockchain.
 */
 
 package main
@@ -15,33 +24,78 @@ import (
 
 	"./blockartlib"
 
+	"bufio"
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/md5"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"math/big"
-	mrand "math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	//"math/big"
 )
 
 var settings blockartlib.MinerNetSettings
 
-var artNodeID int
-
 type MinerKey int
 
-type ArtKey int
+// An ArtKey is created for every incoming connection, so the key an art node
+// authenticates with through ValidateKey is bound to that connection only. net/rpc serves the
+// calls of a connection concurrently, so Nonce and Session are only used under lock.
+type ArtKey struct {
+	lock sync.Mutex
+
+	// Challenge issued by GetNonce, cleared after every ValidateKey attempt
+	Nonce []byte
+
+	// Set once the art node has proven it holds the private key of the session
+	Session *ArtNodeSession
+}
+
+// Limits enforced on the art nodes connected to this miner.
+const (
+	MaxArtNodeSessions      = 16
+	MaxPendingOpsPerSession = 4
+)
+
+// State kept by the miner for one connected art node.
+type ArtNodeSession struct {
+	ID          int
+	ArtNodeID   int
+	PubKey      ecdsa.PublicKey
+	ConnectedAt time.Time
+
+	// UniqueIDs of operations submitted by the art node that are not validated yet
+	PendingOps []string
+
+	// Ink spent by validated AddShape operations during this session
+	InkSpent uint32
+}
+
+type ArtNodeSessions struct {
+	sync.RWMutex
+	nextID int
+	all    map[int]*ArtNodeSession
+}
 
 type MinerInfo struct {
 	Address  net.Addr
@@ -59,49 +113,257 @@ type Miner struct {
 	Cli     *rpc.Client
 }
 
+// Miners this miner is connected to, by address.
+type ConnectedMiners struct {
+	sync.RWMutex
+	all map[string]Miner
+}
+
 type Block struct {
-	PreviousBlock  *Block
-	PreviousHash   string
-	Hash           string
-	SetOPs         []Operation
-	MinerPubKey    ecdsa.PublicKey
-	Nonce          uint32
-	TotalInkAmount uint32 // Total = Bank - Opcost (+ Reward when you mine the block)
-	InkBank        uint32 // Bank  = Previous block total (with same pubkey as yourself)
-	PathLength     int
-	IsEndBlock     bool
-}
-
-type Operation struct {
-	ArtNodeID      int
-	ShapeType      blockartlib.ShapeType
-	UniqueID       string
-	ArtNodePubKey  ecdsa.PublicKey
-	OPSigR         *big.Int
-	OPSigS         *big.Int
-	ValidateNum    int
-	ShapeSvgString string
-	Fill           string
-	Stroke         string
-	OpInkCost      uint32
-	OpType         string
-	Lines          []Line
-	DeleteUniqueID string
-	PathShape      string
-}
-
-type Line struct {
-	Start Point
-	End   Point
-}
-
-type Point struct {
-	X float64
-	Y float64
-}
-
-type LongestBlockChain struct {
-	BlockChain []Block
+	PreviousBlock *Block
+	PreviousHash  string
+	Hash          string
+	SetOPs        []Operation
+
+	// Header version, and the Merkle root of SetOPs that goes in the header (see ComputeBlockHash)
+	Version    uint32
+	MerkleRoot []byte
+
+	MinerPubKey ecdsa.PublicKey
+	Nonce       uint32
+	PathLength  int
+
+	// Changed by the miner when it runs out of nonces (see MineBlock)
+	ExtraNonce uint64
+
+	// Milliseconds since the epoch when the block was mined
+	Timestamp int64
+
+	// Base proof of work target of the chain at this block (see NextTarget and RequiredTarget)
+	Target *big.Int
+
+	// Proof of work of the chain ending in this block (see BlockWork), computed when the
+	// block is stored
+	TotalWork *big.Int
+}
+
+// Operations, and the geometry in them, are the types art nodes build with blockartlib, so that
+// both compute the same operation digest (see blockartlib.OperationDigest).
+type Operation = blockartlib.Operation
+
+type Rect = blockartlib.Rect
+
+type Line = blockartlib.Line
+
+type Point = blockartlib.Point
+
+// The part of a block miners exchange before fetching its body during sync.
+// Header of a block of the longest chain, as sent to miners syncing with it. Everything but the
+// hash and height is covered by the hash, so the headers can be checked before their blocks are
+// fetched (see CheckHeaders).
+type BlockHeader struct {
+	blockartlib.BlockHeader
+	Hash       string
+	PathLength int
+}
+
+// Limits on the number of headers and blocks returned by one GetHeaders or GetBlocks call.
+const (
+	MaxHeadersPerRequest = 500
+	MaxBlocksPerRequest  = 50
+)
+
+// Mining workers check for cancellation every HashBatch hashes. The hash rate is reported every
+// HashRateInterval.
+const (
+	HashBatch        = 1024
+	HashRateInterval = 10 * time.Second
+)
+
+// Time the miner waits before building a new block after it could not build one.
+const TemplateRetryInterval = 100 * time.Millisecond
+
+// Number of blocks kept in the orphan pool, and of ancestors requested for one orphan.
+const MaxOrphanBlocks = 100
+
+// Append-only file of blocks plus an index of the offset of every block in it.
+//
+// blocks.dat is a sequence of records: a 4 byte big-endian payload length, the 4 byte
+// CRC-32 (IEEE) of the payload and the payload, a gob encoded Block without its
+// PreviousBlock link. Parents are always written before their children.
+// blocks.idx holds one "hash offset" line per record and is rebuilt from blocks.dat
+// whenever the two disagree.
+type ChainFile struct {
+	sync.Mutex
+	blocks *os.File
+	index  *os.File
+	offset int64
+}
+
+// State derived from the blocks of a chain. Every block is applied as a BlockDelta that can be
+// reverted, so switching to another fork only touches the blocks after the common ancestor.
+type ChainState struct {
+	sync.RWMutex
+
+	// Last block applied and its height
+	Tip    string
+	Height int
+
+	// Ink of every key (see PubKeyToString)
+	Balances map[string]uint32
+
+	// Add operations of the shapes that are not deleted, by shape hash
+	Shapes map[string]Operation
+
+	// Key owning each live shape, by shape hash
+	Owners map[string]string
+
+	// Block containing each operation on the chain, by UniqueID. Operations that expired before
+	// every block that can still follow the checkpoint are forgotten, unless they are live shapes
+	// at the checkpoint (see ForgetExpiredOperations).
+	OpBlocks map[string]string
+
+	// Reserve operations on the chain, by UniqueID
+	Reservations map[string]Reservation
+
+	// Last checkpoint of the chain, nil if none was taken yet. The state can not be moved to a
+	// chain that forks below it.
+	Checkpoint *Checkpoint
+
+	// Undo information of every block applied since the checkpoint (or the genesis block), Tip last
+	deltas []*BlockDelta
+
+	// Height up to which expired operations were forgotten, and the expired live shapes whose
+	// blocks are kept until they are deleted at a checkpoint
+	forgottenHeight int
+	keptShapes      map[string]bool
+}
+
+// Snapshot of the live shapes and balances of the longest chain at a block buried deep enough
+// that the miner no longer switches to forks below it.
+type Checkpoint struct {
+	Hash     string
+	Height   int
+	Balances map[string]uint32
+	Shapes   map[string]Operation
+}
+
+type Reservation struct {
+	Op     Operation
+	Height int
+}
+
+// Changes made to a ChainState by applying one block.
+type BlockDelta struct {
+	Hash         string
+	PreviousHash string
+
+	// Balances before the block; keys that had no balance yet are in NewKeys instead
+	PrevBalances map[string]uint32
+	NewKeys      []string
+
+	AddedShapes   []string
+	DeletedShapes []Operation
+	Ops           []string
+	Reservations  []string
+}
+
+// Blocks indexed by hash, with an index from every block to its children. Blocks are stored by
+// pointer and never move, so PreviousBlock links stay valid as the store grows. A stored block
+// is not changed afterwards, except for SetOPs being replaced under chainLock by PruneOperations.
+type BlockStore struct {
+	sync.RWMutex
+	blocks   map[string]*Block
+	children map[string][]string
+
+	// Hashes in the order the blocks were added, the genesis block first
+	order []string
+
+	// Blocks without children (the end blocks of every branch)
+	tips map[string]*Block
+
+	// Tip with the most work, the first one stored wins a tie
+	best *Block
+
+	// Blocks that can not be applied to their chain, and their descendants. They are never tips.
+	invalid map[string]bool
+}
+
+// Returned when the chain state can not be moved onto a block. Blocks are only checked against the
+// chain they extend, so a block that fails once fails every time.
+type InvalidBlockError struct {
+	Hash string
+	Err  error
+}
+
+func (e InvalidBlockError) Error() string {
+	return "Block " + e.Hash + " is invalid: " + e.Err.Error()
+}
+
+// Blocks received before their parent, keyed by the hash of the missing parent. When the pool is
+// full the oldest orphan is dropped.
+type OrphanPool struct {
+	sync.Mutex
+	byParent map[string][]Block
+	parents  map[string]string // orphan hash -> parent hash
+	order    []string
+}
+
+// Operations waiting to go in a block, kept until they are on the longest chain or expire, and
+// the UniqueIDs of the operations seen recently so that flooded operations are handled once.
+type Mempool struct {
+	sync.Mutex
+	pending map[string]MempoolEntry
+	order   []string             // UniqueIDs in arrival order, removed ones are dropped on expiry
+	seen    map[string]time.Time // UniqueID -> when it was first seen
+	added   uint64               // operations added so far, to notice new ones
+}
+
+type MempoolEntry struct {
+	Op    Operation
+	Added time.Time
+}
+
+// Operations the miner confirmed to art nodes, watched until they are WatchedOperationDepth blocks
+// deep, and the events of those that left the longest chain (see OperationWatch.Update).
+type OperationWatch struct {
+	sync.Mutex
+	watched map[string]*WatchedOperation
+	events  []OwnedOperationEvent // the last MaxOperationEvents events, oldest first
+	seq     uint64
+}
+
+type WatchedOperation struct {
+	Op    Operation
+	Owner string // key of the art node, as returned by PubKeyToString
+
+	// Block of the longest chain the operation is in, "" while it waits to be mined again
+	BlockHash string
+}
+
+type OwnedOperationEvent struct {
+	Owner string
+	Event blockartlib.OperationEvent
+}
+
+const (
+	WatchedOperationDepth = 100
+	MaxOperationEvents    = 1000
+)
+
+// Operations wait in the mempool for MempoolExpiry, as long as art nodes wait for them to be
+// validated, and their UniqueIDs are remembered for SeenOperationExpiry. A block carries at
+// most MaxBlockOperations operations.
+const (
+	MempoolExpiry       = 2 * time.Minute
+	SeenOperationExpiry = 10 * time.Minute
+	MaxBlockOperations  = 100
+)
+
+// A block sent to a neighbour, with the public address of the miner that sent it.
+type BlockMessage struct {
+	Block  Block
+	Sender string
 }
 
 // Keeps track of all the keys & Miner Address so miner can send it to other miners.
@@ -112,132 +374,115 @@ var minerAddr net.Addr
 
 var tcpAddr net.Addr
 
-// Keeps track of all miners that are connected to this miner. (array/slice or map???)
-var connectedMiners = make(map[string]Miner)
+// Keeps track of all miners that are connected to this miner.
+var connectedMiners = NewConnectedMiners()
 
 // Keeps track of all art nodes that are connected to this miner.
-// var connectedArtNodeMap = make(map[string]ArtNodeInfo)
+var artNodeSessions = ArtNodeSessions{all: make(map[int]*ArtNodeSession)}
 
-// Keeps track of all blocks generated
-// GenesisBlock is at the start of the block
-var blockList = []Block{}
+// Keeps track of all blocks generated, including the ones on forks
+var blockStore = NewBlockStore()
 
-// Queue of incoming operations
-var operations = []Operation{}
+// Blocks waiting for their parent to arrive
+var orphanPool = NewOrphanPool()
 
-// Operations that are seen already (consists of unique shape hash)
-var operationsHistory = make([]string, 0)
+// On-disk copy of blockStore (without the genesis block), replayed on startup
+var chainFile *ChainFile
 
-// GenesisBlock is at the end of the block
-var globalChain []Block
+// Operations that are not on the longest chain yet
+var mempool = NewMempool()
 
-// FUNCTION CALLS
+// Confirmed operations that can still be dropped by a reorg
+var operationWatch = NewOperationWatch()
 
-// Registers incoming Miner that wants to connect.
-func (minerKey *MinerKey) RegisterMiner(minerInfo MinerInfo, reply *MinerInfo) error {
+// Signalled when the tip of the longest chain changes or an operation enters the mempool, so
+// that the block being mined is rebuilt (see NotifyMiner)
+var miningEvents = make(chan struct{}, 1)
 
-	cli, err := rpc.Dial("tcp", minerInfo.Address.String())
+// Number of goroutines mining blocks, and the hashes they computed since the last hash rate report
+var miningWorkers = runtime.NumCPU()
+var hashCount uint64
 
-	miner := Miner{Address: minerInfo.Address, Key: minerInfo.Key, Cli: cli}
-	connectedMiners[miner.Address.String()] = miner
+// GenesisBlock is at the end of the block
+var globalChain []Block
 
-	*reply = MinerInfo{Address: tcpAddr, Key: pubKey}
+// Held for writing while a block is stored and the longest chain is switched (see SetLongestChain),
+// and for reading by whoever reads globalChain or the operations of stored blocks, which pruning
+// replaces. Taken before the locks of blockStore, chainState, mempool and operationWatch.
+var chainLock sync.RWMutex
 
-	return err
-}
+// Ink given to every key (see PubKeyToString) by the genesis block
+var genesisAllocations = make(map[string]uint32)
 
-// Updates the longest block chain in the Miner Network.
-// If a miner receives this call, it will compare the length of blockchain received with their own longest blockchain:
-//		length of blockchain received > length of own longest blockchain -> replace own blockchain with longer and send that to neighbours
-//		length of blockchain received < length of own longest blockchain -> send own blockchain to neighbours
-//		length of blockchain received = length of own longest blockchain -> check if its exactly same as own blockchain
-// If length of blockchain received = length of own longest blockchain:
-// 		exactly the same blockchain -> do not send it to neighbours anymore
-//		not the same blockchain -> keep the blockchain
-func (minerKey *MinerKey) UpdateLongestBlockChain(longestBlockChain LongestBlockChain, reply *string) error {
-	mrand.Seed(time.Now().UnixNano())
+// Balances, live shapes and ownership derived from globalChain
+var chainState = NewChainState()
 
-	ownLongestBlockChain := globalChain
-	var err error
+// FUNCTION CALLS
 
-	// replace own blockList and send to neighbours
-	if len(longestBlockChain.BlockChain) > len(ownLongestBlockChain) {
+// Returns the headers of the longest chain following the first locator hash that is on it,
+// oldest first. If none of the locator hashes are on the longest chain, the headers start
+// after the genesis block.
+func (minerKey *MinerKey) GetHeaders(locator []string, headers *[]BlockHeader) error {
+	*headers = []BlockHeader{}
+	for _, block := range BlocksAfterLocator(locator) {
+		*headers = append(*headers, BlockHeader{BlockHeader: HeaderOf(block), Hash: block.Hash, PathLength: block.PathLength})
+	}
 
-		blockList = longestBlockChain.BlockChain
-		globalChain = blockList
+	return nil
+}
 
-		for _, miner := range connectedMiners {
-			err = miner.Cli.Call("Minerkey.UpdateLongestBlockChain", LongestBlockChain{BlockChain: longestBlockChain.BlockChain}, &reply)
-		}
+// Returns the stored blocks with the given hashes, in the order requested.
+func (minerKey *MinerKey) GetBlocks(hashes []string, blocks *[]Block) error {
+	if len(hashes) > MaxBlocksPerRequest {
+		return errors.New("Too many blocks requested")
+	}
 
-	} else if len(longestBlockChain.BlockChain) < len(ownLongestBlockChain) {
+	chainLock.RLock()
+	defer chainLock.RUnlock()
 
-		// send own longest blockchain to neighbours
-		for _, miner := range connectedMiners {
-			err = miner.Cli.Call("Minerkey.UpdateLongestBlockChain", LongestBlockChain{BlockChain: ownLongestBlockChain}, &reply)
+	*blocks = []Block{}
+	for _, hash := range hashes {
+		block, exists := blockStore.Get(hash)
+		if !exists {
+			return errors.New("Block " + hash + " does not exist")
 		}
+		*blocks = append(*blocks, UnlinkBlock(*block))
+	}
 
-	} else {
+	return nil
+}
 
-		// equal length, check whether blockchain are duplicates
-		isDuplicate := true
+// Registers incoming Miner that wants to connect.
+func (minerKey *MinerKey) RegisterMiner(minerInfo MinerInfo, reply *MinerInfo) error {
 
-		for i := 0; i < len(ownLongestBlockChain); i++ {
-			if ownLongestBlockChain[i].Hash != longestBlockChain.BlockChain[i].Hash {
-				isDuplicate = false
-				break
-			}
-		}
+	cli, err := rpc.Dial("tcp", minerInfo.Address.String())
 
-		if isDuplicate != true {
+	miner := Miner{Address: minerInfo.Address, Key: minerInfo.Key, Cli: cli}
+	connectedMiners.Add(miner)
 
-			// if rand = 1, use the longest blockchain received and update the neighbours. Otherwise, keep own longest blockchain.
-			if mrand.Intn(2-1)+1 == 1 {
-				// TODO
-				blockList = longestBlockChain.BlockChain
-				for _, miner := range connectedMiners {
-					err = miner.Cli.Call("Minerkey.UpdateLongestBlockChain", LongestBlockChain{BlockChain: longestBlockChain.BlockChain}, &reply)
-				}
-			} else {
-				for _, miner := range connectedMiners {
-					err = miner.Cli.Call("Minerkey.UpdateLongestBlockChain", LongestBlockChain{BlockChain: ownLongestBlockChain}, &reply)
-				}
-			}
-		} else {
-			err = nil
-		}
-	}
+	*reply = MinerInfo{Address: tcpAddr, Key: pubKey}
 
 	return err
 }
 
 // Miner receives operation from other miner in the network and will add it into the Operations History Array & Operations Queue
 func (minerKey *MinerKey) ReceiveOperation(operation Operation, reply *bool) error {
-	exists := false
-	for i := 0; i < len(operationsHistory); i++ {
-		if operation.UniqueID == operationsHistory[i] {
-			exists = true
-			break
-		}
-	}
-
-	if exists == false {
-		longestBlockChain := globalChain
-
-		err := ValidateOperationForLongestChain(operation, longestBlockChain)
+	if !mempool.Seen(operation.UniqueID) {
+		err := ValidateOperation(operation, chainState)
 		if err != nil {
 			return err
 		}
 
-		operationsHistory = append(operationsHistory, operation.UniqueID)
-		operations = append(operations, operation)
+		if !mempool.Add(operation) {
+			return nil
+		}
 
-		for key, miner := range connectedMiners {
+		for key, miner := range connectedMiners.All() {
 			err := miner.Cli.Call("MinerKey.ReceiveOperation", operation, &reply)
 
 			if err != nil {
 				if err.Error() == "connection is shut down" {
-					delete(connectedMiners, key)
+					connectedMiners.Remove(key)
 				}
 			}
 		}
@@ -246,36 +491,149 @@ func (minerKey *MinerKey) ReceiveOperation(operation Operation, reply *bool) err
 	return nil
 }
 
+// Issues a random challenge that the art node has to sign with its private key in ValidateKey.
+func (artkey *ArtKey) GetNonce(empty string, nonce *[]byte) error {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+
+	artkey.lock.Lock()
+	artkey.Nonce = challenge
+	artkey.lock.Unlock()
+
+	*nonce = challenge
+
+	return nil
+}
+
+// Verifies the art node's signature over the nonce issued by GetNonce. On success the connection
+// is bound to the art node's public key, otherwise an InvalidKeyError is returned.
 func (artkey *ArtKey) ValidateKey(artNodeKey blockartlib.ArtNodeKey, canvasSettings *blockartlib.CanvasSettings) error {
+	artkey.lock.Lock()
+	defer artkey.lock.Unlock()
+
+	nonce := artkey.Nonce
+	artkey.Nonce = nil
+
+	if nonce == nil || !bytes.Equal(nonce, artNodeKey.Hash) {
+		return blockartlib.InvalidKeyError("nonce was not issued by this miner")
+	}
 
-	if ecdsa.Verify(&pubKey, artNodeKey.Hash, artNodeKey.R, artNodeKey.S) == true {
-		*canvasSettings = settings.CanvasSettings
+	pubKey, valid := blockartlib.CheckPublicKey(artNodeKey.PubKey)
+	if !valid {
+		return blockartlib.InvalidKeyError("public key is not a P-384 key")
 	}
+	if artNodeKey.R == nil || artNodeKey.S == nil || !ecdsa.Verify(&pubKey, nonce, artNodeKey.R, artNodeKey.S) {
+		return blockartlib.InvalidKeyError("signature does not match public key")
+	}
+
+	// validating again on the same connection replaces the previous session
+	artkey.closeSession()
+
+	session, err := OpenSession(artNodeKey.ArtNodeID, artNodeKey.PubKey)
+	if err != nil {
+		return err
+	}
+	artkey.Session = session
 
-	artNodeID = artNodeKey.ArtNodeID
+	*canvasSettings = settings.CanvasSettings
 
 	return nil
 }
 
-func (artkey *ArtKey) AddShape(operation Operation, reply *Block) error {
-	longestBlockChain := globalChain
+// Returns an InvalidKeyError if the art node on this connection has not passed ValidateKey.
+func (artkey *ArtKey) CheckAuthorized() error {
+	_, err := artkey.AuthorizedSession()
+	return err
+}
+
+// Returns the session of the art node on this connection, or an InvalidKeyError if it has not
+// passed ValidateKey. The session stays usable if the connection closes it meanwhile.
+func (artkey *ArtKey) AuthorizedSession() (*ArtNodeSession, error) {
+	artkey.lock.Lock()
+	defer artkey.lock.Unlock()
+
+	if artkey.Session == nil {
+		return nil, blockartlib.InvalidKeyError("art node has not been validated")
+	}
+	return artkey.Session, nil
+}
+
+// Returns the session of the art node on this connection, or an InvalidKeyError if the operation
+// was not issued with the key bound to this connection.
+func (artkey *ArtKey) CheckOperationKey(operation Operation) (*ArtNodeSession, error) {
+	session, err := artkey.AuthorizedSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if !reflect.DeepEqual(session.PubKey, operation.ArtNodePubKey) || session.ArtNodeID != operation.ArtNodeID {
+		return nil, blockartlib.InvalidKeyError("operation was not issued by the validated art node")
+	}
+	return session, nil
+}
+
+// Ends the art node's session, called from CloseCanvas and when the connection drops.
+func (artkey *ArtKey) CloseSession() {
+	artkey.lock.Lock()
+	defer artkey.lock.Unlock()
+
+	artkey.closeSession()
+}
+
+func (artkey *ArtKey) closeSession() {
+	if artkey.Session != nil {
+		CloseSession(artkey.Session.ID)
+		artkey.Session = nil
+	}
+}
+
+// Closes the session of this connection and returns the ink remaining for its key.
+func (artkey *ArtKey) CloseCanvas(empty string, inkAmount *uint32) error {
+	if err := artkey.GetInk(empty, inkAmount); err != nil {
+		return err
+	}
+
+	artkey.CloseSession()
+	return nil
+}
+
+// Returns the status of every art node session on this miner.
+func (artkey *ArtKey) GetSessions(empty string, sessions *[]blockartlib.SessionStatus) error {
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	*sessions = SessionStatuses()
+	return nil
+}
 
-	err := ValidateOperationForLongestChain(operation, longestBlockChain)
+func (artkey *ArtKey) AddShape(operation Operation, reply *Block) error {
+	session, err := artkey.CheckOperationKey(operation)
 	if err != nil {
 		return err
 	}
 
-	operationsHistory = append(operationsHistory, operation.UniqueID)
-	operations = append(operations, operation)
+	if err := ValidateOperation(operation, chainState); err != nil {
+		return err
+	}
+
+	if err := AddPendingOp(session, operation.UniqueID); err != nil {
+		return err
+	}
+	defer RemovePendingOp(session, operation.UniqueID)
+
+	mempool.Add(operation)
 
 	// Floods the network of miners with Operations
-	for key, miner := range connectedMiners {
+	for key, miner := range connectedMiners.All() {
 
 		err := miner.Cli.Call("MinerKey.ReceiveOperation", operation, &reply)
 
 		if err != nil {
 			if err.Error() == "connection is shut down" {
-				delete(connectedMiners, key)
+				connectedMiners.Remove(key)
 			}
 		}
 	}
@@ -284,227 +642,362 @@ func (artkey *ArtKey) AddShape(operation Operation, reply *Block) error {
 	block, valid := CheckOperationValidation(operation.UniqueID)
 
 	if valid {
+		AddInkSpent(session, operation.OpInkCost)
+		operationWatch.Watch(operation)
 		*reply = block
 	}
 
 	return nil
 }
 
-func (artkey *ArtKey) GetInk(empty string, inkAmount *uint32) error {
-	longestBlockChain := globalChain
-	for i := len(longestBlockChain) - 1; i >= 0; i-- {
-		if reflect.DeepEqual(blockList[i].MinerPubKey, pubKey) {
-			*inkAmount = blockList[i].TotalInkAmount
-			break
-		}
+// Reserves a region of the canvas for the art node's key, see ValidateReservation.
+func (artkey *ArtKey) ReserveRegion(operation Operation, reply *Block) error {
+	if operation.OpType != "Reserve" {
+		return errors.New("Not a reserve operation")
 	}
-	return nil
+
+	return artkey.AddShape(operation, reply)
 }
 
-// UNUSED
-func GetInkAmount(prevBlock *Block) uint32 {
-	temp := *prevBlock
-	for i := prevBlock.PathLength; i > 1; i-- {
-		if reflect.DeepEqual(temp.MinerPubKey, pubKey) {
-			return temp.TotalInkAmount
-			break
-		}
-		temp = *temp.PreviousBlock
+func (artkey *ArtKey) GetInk(empty string, inkAmount *uint32) error {
+	session, err := artkey.AuthorizedSession()
+	if err != nil {
+		return err
 	}
-	return 0
+
+	*inkAmount = chainState.Balance(session.PubKey)
+	return nil
 }
 
 func GenerateBlock() {
-
 	for {
-		var difficulty int
-		var isNoOp bool
-		var prevBlock *Block
-		var copyOfOps []Operation
-
-		newBlock := Block{Nonce: 0, MinerPubKey: pubKey}
-
-		if len(operations) > 0 {
-			if len(operations) > 1 && CheckIntersectionWithinOp(operations) {
-				copyOfOps = make([]Operation, 1)
-				copy(copyOfOps, []Operation{operations[0]})
-				operations = append(operations[:0], operations[1:]...)
-			} else {
-				copyOfOps = make([]Operation, len(operations))
-				copy(copyOfOps, operations)
-				operations = operations[:0]
-			}
-			isNoOp = false
-
-			newBlock.SetOPs = copyOfOps
-			difficulty = int(settings.PoWDifficultyOpBlock)
-		} else {
-			isNoOp = true
-			difficulty = int(settings.PoWDifficultyNoOpBlock)
-		}
+		MineNextBlock()
+	}
+}
 
-		endBlocks := FindLastBlockOfLongestChain()
+// Builds a block on the tip to mine on and mines it until it is found or the miner is notified
+// (see NotifyMiner), then stores the block and sends it to the connected miners. Reports whether
+// a block was mined.
+func MineNextBlock() bool {
+	chainLock.Lock()
+	prevBlock, newBlock, ok := NewBlockTemplate()
+	chainLock.Unlock()
+	if !ok {
+		time.Sleep(TemplateRetryInterval)
+		return false
+	}
 
-		if len(endBlocks) > 1 {
-			if !isNoOp {
-				prevBlock = SelectValidBranch(endBlocks, newBlock)
-			} else {
-				prevBlock = SelectRandomBranch(endBlocks)
-			}
-		} else {
-			prevBlock = endBlocks[0]
-		}
+	target := RequiredTarget(newBlock)
 
-		globalChain = FindBlockChainPath(*prevBlock)
+	block, found := MineBlock(newBlock, target, miningWorkers, miningEvents)
+	if !found {
+		return false
+	}
 
-		prevBlockHash := (*prevBlock).Hash
-		newBlock.PreviousHash = prevBlockHash
+	block.PathLength = prevBlock.PathLength + 1
+	block.PreviousBlock = prevBlock
 
-		zeroString := strings.Repeat("0", difficulty)
+	chainLock.Lock()
+	SaveBlock(&block)
+	SetLongestChain(FindLongestChainTip())
+	message := UnlinkBlock(block)
+	chainLock.Unlock()
 
-		for {
-			if isNoOp && len(operations) > 0 {
-				break
-			}
+	SendBlockInfo(message)
+	return true
+}
 
-			if (*prevBlock).Hash != globalChain[len(globalChain)-1].Hash {
-				break
-			}
+// Switches to the branch to mine on and returns its tip with a block extending it, filled from
+// the mempool but not mined yet. Returns false if the switch failed. The caller holds chainLock.
+func NewBlockTemplate() (*Block, Block, bool) {
+	var prevBlock *Block
 
-			hash := ComputeBlockHash(newBlock)
-			subString := hash[len(hash)-difficulty:]
-			if zeroString == subString {
-				newBlock.Hash = hash
-				newBlock.IsEndBlock = true
-				newBlock.PathLength = prevBlock.PathLength + 1
-				newBlock.PreviousBlock = prevBlock
-				newBlock.InkBank = prevBlock.TotalInkAmount
-				newBlock.TotalInkAmount = newBlock.InkBank + ComputeOpCostForMiner(newBlock.MinerPubKey, copyOfOps)
-				prevBlock.IsEndBlock = false
-
-				if len(copyOfOps) == 0 {
-					newBlock.TotalInkAmount = newBlock.TotalInkAmount + settings.InkPerNoOpBlock
-				} else {
-					newBlock.TotalInkAmount = newBlock.TotalInkAmount + settings.InkPerOpBlock
-				}
+	newBlock := Block{Version: blockartlib.BlockVersion, Nonce: 0, MinerPubKey: pubKey}
 
-				blockList = append(blockList, newBlock)
-				globalChain = FindLongestBlockChain()
+	endBlocks := FindMostWorkTips()
 
-				SendBlockInfo(newBlock)
-				break
-			}
-			newBlock.Nonce = newBlock.Nonce + 1
-		}
+	if len(endBlocks) > 1 {
+		prevBlock = SelectBranch(endBlocks)
+	} else {
+		prevBlock = endBlocks[0]
 	}
-}
 
-// Select valid branch among > 1 longest nodes
-// If all branches are valid, then choose one at random
-func SelectValidBranch(endBlocks []*Block, newBlock Block) *Block {
-	var validEndBlocks []*Block
-	var err error
-	for _, block := range endBlocks {
-		currPath := FindBlockChainPath(*block)
-		for _, op := range newBlock.SetOPs {
-			err = ValidateOperationForLongestChain(op, currPath)
-			if err != nil {
-				break
-			}
-		}
-		validEndBlocks = append(validEndBlocks, block)
+	SetLongestChain(prevBlock)
+
+	// the block built below covers the events up to here
+	DrainMiningEvents()
+	if prevBlock.Hash != chainState.TipHash() {
+		return nil, Block{}, false
 	}
 
-	if len(validEndBlocks) > 1 {
-		return SelectRandomBranch(validEndBlocks)
-	} else if len(validEndBlocks) == 1 {
-		return validEndBlocks[0]
+	prevBlockHash := (*prevBlock).Hash
+	newBlock.PreviousHash = prevBlockHash
+
+	newBlock.Target = NextTarget(prevBlock)
+	newBlock.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	if medianTime := MedianTimePast(prevBlock); newBlock.Timestamp <= medianTime {
+		newBlock.Timestamp = medianTime + 1
 	}
-	return nil
-}
 
-// Selects random node in the given array
-func SelectRandomBranch(endBlocks []*Block) *Block {
-	length := len(endBlocks)
-	mrand.Seed(time.Now().Unix())
-	randIndex := mrand.Intn(length - 1)
+	// operations that are not valid on the chain yet stay in the mempool until they expire
+	newBlock.SetOPs = SelectValidOperations(prevBlock, newBlock.Timestamp, mempool.Pending())
+	newBlock.MerkleRoot = blockartlib.MerkleRoot(newBlock.SetOPs)
 
-	return endBlocks[randIndex]
+	return prevBlock, newBlock, true
 }
 
-// returns true if there is an intersection within operation set
-func CheckIntersectionWithinOp(operations []Operation) bool {
-	length := len(operations)
-	// for every op in operations, for every line segment in the op, compare to next operation's every line segment.
-	for i := 0; i < length; i++ {
-		for j := 0; j < length; j++ {
-			if i != j {
-				for _, line1 := range operations[i].Lines {
-					//each line of op1 is compared against op2's lines
-					for _, line2 := range operations[j].Lines {
-						if CheckIntersectionLines(line1.Start, line1.End, line2.Start, line2.End) && operations[i].ArtNodeID != operations[j].ArtNodeID {
-							return true
-						}
-					}
-				}
-			}
-		}
+// Searches for a nonce that makes the hash of the block meet target on the given number of
+// goroutines. Worker i hashes every nonce with extra-nonces i, i + workers, i + 2 * workers, ...
+// so no two workers hash the same header and none of them runs out of nonces. Returns the block
+// with its nonce and hash set, or false if stop is signalled first.
+func MineBlock(template Block, target *big.Int, workers int, stop <-chan struct{}) (Block, bool) {
+	if workers < 1 {
+		workers = 1
 	}
-	return false
-}
 
-// Checks for any possible intersection between one operation and the operations in
-// the longest block chain
-// returns error if there is an intersection, nil if there isn't
-func CheckIntersection(operation Operation) error {
-	blockChain := globalChain
-	for _, line := range operation.Lines {
-		deletes := []Operation{}
-		start := line.Start
-		end := line.End
-		for k := len(blockChain) - 1; k > 0; k-- {
-			for _, op := range blockChain[k].SetOPs {
-				for _, opLine := range op.Lines {
-					opStart := opLine.Start
-					opEnd := opLine.End
-					if CheckIntersectionLines(start, end, opStart, opEnd) && operation.ArtNodeID != op.ArtNodeID {
-						if op.OpType == "Add" {
-							exists := false
-							for i, delOp := range deletes {
-								if delOp.DeleteUniqueID == operation.UniqueID {
-									deletes = append(deletes[:i], deletes[i+1:]...)
-									exists = true
-									break
-								}
-							}
-							if !exists {
-								return blockartlib.ShapeOverlapError(op.UniqueID)
-							}
-						} else {
-							deletes = append(deletes, op)
+	found := make(chan Block, workers)
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		block := template
+		block.ExtraNonce = uint64(i)
+
+		wg.Add(1)
+		go func(block Block) {
+			defer wg.Done()
+
+			for {
+				for nonce := uint64(0); nonce <= math.MaxUint32; nonce++ {
+					if nonce%HashBatch == 0 && nonce > 0 {
+						atomic.AddUint64(&hashCount, HashBatch)
+						select {
+						case <-quit:
+							return
+						default:
 						}
-						break
+					}
+
+					block.Nonce = uint32(nonce)
+					hash := ComputeBlockHash(block)
+					if blockartlib.HashMeetsTarget(hash, target) {
+						block.Hash = hash
+						found <- block
+						return
 					}
 				}
+				block.ExtraNonce += uint64(workers)
 			}
-		}
+		}(block)
 	}
-	return nil
-}
-
-// Checks if given set of points intersect
-// Logic sourced from www.geeksforgeeks.org/check-if-two-given-line-segments-intersect/
-func CheckIntersectionLines(p1 Point, p2 Point, p3 Point, p4 Point) bool {
-	o1 := Orientation(p1, p2, p3)
-	o2 := Orientation(p1, p2, p4)
-	o3 := Orientation(p3, p4, p1)
-	o4 := Orientation(p3, p4, p2)
 
-	if o1 != o2 && o3 != o4 {
-		return true
+	var block Block
+	var ok bool
+	select {
+	case block = <-found:
+		ok = true
+	case <-stop:
 	}
 
-	return false
+	close(quit)
+	wg.Wait()
+
+	return block, ok
+}
+
+// Makes the miner rebuild the block it is mining. Does not block: one pending event is enough.
+func NotifyMiner() {
+	select {
+	case miningEvents <- struct{}{}:
+	default:
+	}
+}
+
+func DrainMiningEvents() {
+	select {
+	case <-miningEvents:
+	default:
+	}
+}
+
+// Goroutine that prints the hash rate of the mining workers every HashRateInterval.
+func ReportHashRate() {
+	for {
+		time.Sleep(HashRateInterval)
+
+		hashes := atomic.SwapUint64(&hashCount, 0)
+		fmt.Printf("Hash rate: %.0f hashes/s on %d workers\n", float64(hashes)/HashRateInterval.Seconds(), miningWorkers)
+	}
+}
+
+// Picks one of the tips that have the same work. The current tip wins if it is one of them, as
+// it was seen first; otherwise the tip with the lowest hash wins, so that every miner picks the
+// same one.
+func SelectBranch(endBlocks []*Block) *Block {
+	currentTip := chainState.TipHash()
+
+	selected := endBlocks[0]
+	for _, block := range endBlocks {
+		if block.Hash == currentTip {
+			return block
+		}
+		if block.Hash < selected.Hash {
+			selected = block
+		}
+	}
+
+	return selected
+}
+
+// Returns the "Reserve" operations that still cover the block that would be added on top of the state's tip.
+// A reservation made in a block at height h covers the next ReserveBlocks blocks (h+1 ... h+ReserveBlocks).
+// The caller must hold the state's lock.
+func ActiveReservations(state *ChainState) []Operation {
+	reservations := []Operation{}
+
+	nextHeight := state.Height + 1
+	for _, reservation := range state.Reservations {
+		if reservation.Height+reservation.Op.ReserveBlocks >= nextHeight {
+			reservations = append(reservations, reservation.Op)
+		}
+	}
+
+	return reservations
+}
+
+// Returns a RegionReservedError if the shape covers part of a region that another key holds an
+// active reservation for.
+func CheckReservations(operation Operation, state *ChainState) error {
+	for _, reservation := range ActiveReservations(state) {
+		if reflect.DeepEqual(reservation.ArtNodePubKey, operation.ArtNodePubKey) {
+			continue
+		}
+
+		if ShapeCoversRect(operation, reservation.Region) {
+			return blockartlib.RegionReservedError(reservation.UniqueID)
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the shape and the rectangle share a point: a line of the shape crosses the
+// rectangle or lies inside it, or the shape is filled and the rectangle lies inside its area.
+func ShapeCoversRect(operation Operation, rect Rect) bool {
+	for _, line := range operation.Lines {
+		if LineIntersectsRect(line, rect) {
+			return true
+		}
+	}
+
+	// no line reaches the rectangle, so it is either outside the shape or entirely inside it
+	center := Point{X: (rect.MinX + rect.MaxX) / 2, Y: (rect.MinY + rect.MaxY) / 2}
+	return operation.Fill != "transparent" && PointInPolygon(center, operation.Lines)
+}
+
+// Validates the region, duration and ink cost of a "Reserve" operation and checks that it does not
+// overlap an active reservation of another key.
+func ValidateReservation(operation Operation, state *ChainState) error {
+	region := operation.Region
+	if region.MinX < 0 || region.MinY < 0 || region.MinX >= region.MaxX || region.MinY >= region.MaxY ||
+		region.MaxX > float64(settings.CanvasSettings.CanvasXMax) || region.MaxY > float64(settings.CanvasSettings.CanvasYMax) {
+		return blockartlib.OutOfBoundsError{}
+	}
+
+	if operation.ReserveBlocks < 1 || operation.ReserveBlocks > blockartlib.MaxReserveBlocks {
+		return errors.New("Invalid number of reserved blocks")
+	}
+
+	if operation.OpInkCost != blockartlib.CalcReserveInk(blockartlib.Rect(region), uint32(operation.ReserveBlocks)) {
+		return errors.New("Reservation ink cost does not match its region")
+	}
+
+	for _, reservation := range ActiveReservations(state) {
+		if !reflect.DeepEqual(reservation.ArtNodePubKey, operation.ArtNodePubKey) && RectsOverlap(reservation.Region, region) {
+			return blockartlib.RegionReservedError(reservation.UniqueID)
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the line segment has a point inside (or on the border of) the rectangle.
+func LineIntersectsRect(line Line, rect Rect) bool {
+	if PointInRect(line.Start, rect) || PointInRect(line.End, rect) {
+		return true
+	}
+
+	corners := []Point{{X: rect.MinX, Y: rect.MinY}, {X: rect.MaxX, Y: rect.MinY}, {X: rect.MaxX, Y: rect.MaxY}, {X: rect.MinX, Y: rect.MaxY}}
+	for i := range corners {
+		if CheckIntersectionLines(line.Start, line.End, corners[i], corners[(i+1)%len(corners)]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func PointInRect(point Point, rect Rect) bool {
+	return point.X >= rect.MinX && point.X <= rect.MaxX && point.Y >= rect.MinY && point.Y <= rect.MaxY
+}
+
+// Returns true if the point is inside the polygon through the start points of the lines (the
+// area filled shapes are charged for), counting the edges that a ray from the point to the right
+// crosses.
+func PointInPolygon(point Point, lines []Line) bool {
+	inside := false
+	for i := range lines {
+		start, end := lines[i].Start, lines[(i+1)%len(lines)].Start
+		if (start.Y > point.Y) != (end.Y > point.Y) {
+			crossX := start.X + (point.Y-start.Y)*(end.X-start.X)/(end.Y-start.Y)
+			if point.X < crossX {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func RectsOverlap(rect1 Rect, rect2 Rect) bool {
+	return rect1.MinX < rect2.MaxX && rect2.MinX < rect1.MaxX && rect1.MinY < rect2.MaxY && rect2.MinY < rect1.MaxY
+}
+
+// Checks for any possible intersection between one operation and the live shapes of other
+// keys in the state (deleted shapes are not live anymore).
+// returns error if there is an intersection, nil if there isn't
+// The caller must hold the state's lock.
+func CheckIntersection(operation Operation, state *ChainState) error {
+	key := PubKeyToString(operation.ArtNodePubKey)
+	for _, line := range operation.Lines {
+		start := line.Start
+		end := line.End
+		for shapeHash, op := range state.Shapes {
+			if state.Owners[shapeHash] == key {
+				continue
+			}
+			for _, opLine := range op.Lines {
+				if CheckIntersectionLines(start, end, opLine.Start, opLine.End) {
+					return blockartlib.ShapeOverlapError(op.UniqueID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Checks if given set of points intersect
+// Logic sourced from www.geeksforgeeks.org/check-if-two-given-line-segments-intersect/
+func CheckIntersectionLines(p1 Point, p2 Point, p3 Point, p4 Point) bool {
+	o1 := Orientation(p1, p2, p3)
+	o2 := Orientation(p1, p2, p4)
+	o3 := Orientation(p3, p4, p1)
+	o4 := Orientation(p3, p4, p2)
+
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+
+	return false
 }
 
 // Find orientation of the triplet points
@@ -523,65 +1016,199 @@ func Orientation(c1 Point, c2 Point, c3 Point) int {
 	}
 }
 
-func FindLongestBlockChain() []Block {
-	endNodes := FindLastBlockOfLongestChain()
+// Returns the tip of the chain with the most work.
+func FindLongestChainTip() *Block {
+	return blockStore.Best()
+}
+
+// Switches the chain state to the chain ending in tip and updates globalChain. If a block on the
+// new chain cannot be applied, it is marked invalid together with its descendants and the state
+// moves to the best chain that is left instead. The caller holds chainLock.
+func SetLongestChain(tip *Block) {
+	for {
+		err := chainState.SwitchTo(tip)
+		if err == nil {
+			break
+		}
+		fmt.Println("Could not switch to chain ending in " + tip.Hash + ": " + err.Error())
+
+		invalid, isInvalid := err.(InvalidBlockError)
+		if !isInvalid {
+			return
+		}
+		// every switch marks at least one block, and the genesis block is always valid
+		blockStore.MarkInvalid(invalid.Hash)
+		tip = blockStore.Best()
+	}
 
-	if len(endNodes) > 1 {
-		randNode := SelectRandomBranch(endNodes)
-		return FindBlockChainPath(*randNode)
+	// globalChain is moved back to the fork point and the new branch appended, rather than
+	// rebuilt from the genesis block; it is only read while holding chainLock
+	fork := tip.PathLength
+	added := []Block{}
+	for block := tip; block != nil && (block.PathLength > len(globalChain) || globalChain[block.PathLength-1].Hash != block.Hash); block = block.PreviousBlock {
+		added = append(added, *block)
+		fork = block.PathLength - 1
 	}
-	return FindBlockChainPath(*endNodes[0])
-}
+	ReverseArray(added)
 
-func FindLastBlockOfLongestChain() []*Block {
-	tempMaxLength := -1
-	lastBlocks := []*Block{}
+	removed := append([]Block{}, globalChain[fork:]...)
+	globalChain = append(globalChain[:fork], added...)
+	UpdateMempool(removed, added)
+	operationWatch.Update()
 
-	for {
-		for i := len(blockList) - 1; i >= 0; i-- {
-			currBlock := blockList[i]
+	if len(removed) > 0 || len(added) > 0 {
+		NotifyMiner()
+	}
 
-			if currBlock.IsEndBlock && currBlock.PathLength >= tempMaxLength {
-				if currBlock.PathLength > tempMaxLength {
-					lastBlocks = []*Block{}
-					tempMaxLength = currBlock.PathLength
-				}
-				lastBlocks = append(lastBlocks, &blockList[i])
+	UpdateCheckpoint(tip)
+}
+
+// Removes the operations of the blocks that joined the longest chain from the mempool, and puts
+// back the operations of the blocks that left it, unless the new chain has them too.
+func UpdateMempool(removed []Block, added []Block) {
+	for _, block := range added {
+		for _, op := range block.SetOPs {
+			mempool.Remove(op.UniqueID)
+		}
+	}
+
+	for _, block := range removed {
+		for _, op := range block.SetOPs {
+			if !op.Pruned && chainState.OperationBlock(op.UniqueID) == "" {
+				mempool.Restore(op)
 			}
 		}
+	}
+}
 
-		if len(lastBlocks) > 0 {
-			break
+// Takes a checkpoint at the last multiple of CheckpointInterval that is at least CheckpointInterval
+// blocks below the tip, if it is newer than the current one, and prunes the operations that no
+// longer affect live shapes when PruneOperations is set.
+func UpdateCheckpoint(tip *Block) {
+	if settings.CheckpointInterval == 0 {
+		return
+	}
+
+	height := CheckpointHeightAt(tip.PathLength)
+	previousHeight := chainState.CheckpointHeight()
+	if height <= previousHeight {
+		return
+	}
+
+	block := tip
+	for block.PathLength > height {
+		block = block.PreviousBlock
+	}
+
+	checkpoint := &Checkpoint{Hash: block.Hash, Height: block.PathLength, Balances: make(map[string]uint32), Shapes: make(map[string]Operation)}
+	err := chainState.WithChain(block, func(state *ChainState) error {
+		for key, ink := range state.Balances {
+			checkpoint.Balances[key] = ink
+		}
+		for shapeHash, op := range state.Shapes {
+			checkpoint.Shapes[shapeHash] = op
 		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Could not take checkpoint at " + block.Hash + ": " + err.Error())
+		return
 	}
 
-	return lastBlocks
+	chainState.SetCheckpoint(checkpoint)
+	chainState.ForgetExpiredOperations(block)
+
+	if settings.PruneOperations {
+		PruneOperations(block, previousHeight, checkpoint)
+	}
+}
+
+// Returns the height of the checkpoint taken when the tip of the longest chain is at height: the
+// last multiple of CheckpointInterval that is at least CheckpointInterval blocks below it.
+func CheckpointHeightAt(height int) int {
+	interval := int(settings.CheckpointInterval)
+	if interval == 0 || height < interval {
+		return 0
+	}
+	return (height - interval) / interval * interval
+}
+
+// Returns the height up to which a miner whose longest chain ends at height may have pruned the
+// operations of its blocks, or 0 if the network does not prune.
+func PrunedHeightAt(height int) int {
+	if !settings.PruneOperations {
+		return 0
+	}
+	return CheckpointHeightAt(height)
 }
 
-func FindBlockChainPath(block Block) []Block {
-	tempBlock := block
-	path := []Block{}
+// Strips the bodies of the operations in the blocks after the previous checkpoint, up to and
+// including block, that are not live shapes at the checkpoint. The fields the chain state needs to
+// apply the block are kept, and so is the digest of the body, so the Merkle root and branches of
+// the block can still be computed. The operations are copied rather than changed in
+// place, since readers may still hold the previous ones, and the copy of the block in
+// globalChain gets them too. The caller holds chainLock.
+func PruneOperations(block *Block, previousHeight int, checkpoint *Checkpoint) {
+	for ; block != nil && block.PathLength > previousHeight; block = block.PreviousBlock {
+		operations := make([]Operation, len(block.SetOPs))
+		copy(operations, block.SetOPs)
+
+		for i, op := range operations {
+			if _, live := checkpoint.Shapes[op.UniqueID]; live || op.Pruned {
+				continue
+			}
+
+			operations[i] = Operation{
+				ArtNodeID:      op.ArtNodeID,
+				ShapeType:      op.ShapeType,
+				UniqueID:       op.UniqueID,
+				ArtNodePubKey:  op.ArtNodePubKey,
+				OpInkCost:      op.OpInkCost,
+				OpType:         op.OpType,
+				DeleteUniqueID: op.DeleteUniqueID,
+				Region:         op.Region,
+				ReserveBlocks:  op.ReserveBlocks,
+				Expires:        op.Expires,
+				Pruned:         true,
+				BodyHash:       blockartlib.OperationBodyHash(op),
+			}
+		}
 
-	for i := block.PathLength; i > 1; i-- {
-		path = append(path, tempBlock)
-		tempBlock = *tempBlock.PreviousBlock
+		block.SetOPs = operations
+		if block.PathLength <= len(globalChain) && globalChain[block.PathLength-1].Hash == block.Hash {
+			globalChain[block.PathLength-1].SetOPs = operations
+		}
 	}
+}
+
+// Returns the tips that have the most work.
+func FindMostWorkTips() []*Block {
+	var maxWork *big.Int
+	lastBlocks := []*Block{}
 
-	path = append(path, tempBlock)
-	ReverseArray(path)
+	for _, currBlock := range blockStore.Tips() {
+		if maxWork == nil || currBlock.TotalWork.Cmp(maxWork) >= 0 {
+			if maxWork == nil || currBlock.TotalWork.Cmp(maxWork) > 0 {
+				lastBlocks = []*Block{}
+				maxWork = currBlock.TotalWork
+			}
+			lastBlocks = append(lastBlocks, currBlock)
+		}
+	}
 
-	return path
+	return lastBlocks
 }
 
 // send out the block information to peers in the connected network of miners
 func SendBlockInfo(block Block) error {
 	replyStr := ""
+	block = UnlinkBlock(block)
 
-	for key, miner := range connectedMiners {
-		err := miner.Cli.Call("MinerKey.ReceiveBlock", block, &replyStr)
+	for key, miner := range connectedMiners.All() {
+		err := miner.Cli.Call("MinerKey.ReceiveBlock", BlockMessage{Block: block, Sender: tcpAddr.String()}, &replyStr)
 		if err != nil {
 			if err.Error() == "connection is shut down" {
-				delete(connectedMiners, key)
+				connectedMiners.Remove(key)
 			}
 		}
 	}
@@ -590,34 +1217,83 @@ func SendBlockInfo(block Block) error {
 }
 
 // once information about a block is received unpack that message and update ink-miner
-func (minerKey *MinerKey) ReceiveBlock(receivedBlock Block, reply *string) error {
-	hash := receivedBlock.Hash
-	previousHash := receivedBlock.PreviousHash
-	operations := receivedBlock.SetOPs
+// If the parent of the block has not arrived yet, the block is kept in the orphan pool and its
+// missing ancestors are requested from the sender.
+func (minerKey *MinerKey) ReceiveBlock(message BlockMessage, reply *string) error {
+	receivedBlock := message.Block
 
 	// Already exists in local blockchain, do nothing
-	if ExistInLocalBlockchain(hash) {
+	if ExistInLocalBlockchain(receivedBlock.Hash) || orphanPool.Contains(receivedBlock.Hash) {
 		return nil
 	}
 
-	// Check if received block is a No-Op or Op block based on length of operations
-	if len(operations) == 0 {
-		if !ComputeTrailingZeroes(hash, settings.PoWDifficultyNoOpBlock) {
-			return errors.New("No-op block proof of work does not match the zeroes")
+	if !ExistInLocalBlockchain(receivedBlock.PreviousHash) {
+		if err := CheckOrphanBlock(receivedBlock); err != nil {
+			return err
 		}
-	} else {
-		if ComputeTrailingZeroes(hash, settings.PoWDifficultyOpBlock) {
-			for _, op := range operations {
-				err := ValidateOperationForLongestChain(op, globalChain)
-				if err != nil {
-					return errors.New("Block contains operations that failed to validate")
-				}
-			}
-		} else {
-			return errors.New("Op block proof of work does not match the zeroes")
+
+		orphanPool.Add(receivedBlock)
+		if miner, exists := connectedMiners.Get(message.Sender); exists {
+			go FetchAncestors(miner, receivedBlock.PreviousHash)
+		}
+		return nil
+	}
+
+	if err := AcceptBlock(receivedBlock); err != nil {
+		return err
+	}
+
+	SendBlockInfo(receivedBlock)
+
+	return nil
+}
+
+// Validates a block received from another miner and, if it is valid, stores it and switches to
+// the longest chain. The parent of the block has to be stored already.
+func AcceptBlock(receivedBlock Block) error {
+	return AcceptPrunedBlock(receivedBlock, 0)
+}
+
+// Like AcceptBlock, but the block may carry pruned operations if it is at most at prunedHeight,
+// the height up to which the miner it comes from has pruned, derived from headers this miner
+// checked (see CheckHeaders and PrunedHeightAt). Pruned operations can not be checked against
+// their signatures, only against the Merkle root of the header (see blockartlib.MerkleLeaf).
+func AcceptPrunedBlock(receivedBlock Block, prunedHeight int) error {
+	if err := CheckBlockHash(receivedBlock); err != nil {
+		return err
+	}
+
+	if receivedBlock.Timestamp > (time.Now().Add(blockartlib.MaxFutureBlockTime).UnixNano() / int64(time.Millisecond)) {
+		return errors.New("Block timestamp is too far in the future")
+	}
+
+	if parent, exists := blockStore.Get(receivedBlock.PreviousHash); exists {
+		if err := CheckPrunedHeight(receivedBlock, parent, prunedHeight); err != nil {
+			return err
 		}
 	}
 
+	if err := CheckBlockOperations(receivedBlock); err != nil {
+		return err
+	}
+
+	chainLock.Lock()
+	err := ConnectBlock(receivedBlock)
+	chainLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ConnectOrphans(receivedBlock.Hash)
+
+	return nil
+}
+
+// Checks a block against the chain it extends and, if it is valid there, stores it and switches
+// to the longest chain. The caller holds chainLock.
+func ConnectBlock(receivedBlock Block) error {
+	previousHash := receivedBlock.PreviousHash
+
 	// Check if previous hash is a block that exists in the block chain
 	var previousBlock *Block
 	if prevBlock, exists := CheckPreviousBlock(previousHash); exists {
@@ -626,144 +1302,1973 @@ func (minerKey *MinerKey) ReceiveBlock(receivedBlock Block, reply *string) error
 		return errors.New("Failed to validate hash of a previous block")
 	}
 
-	// After all validations pass, we set properties of block, append to blockchain and send to network
+	if blockStore.IsInvalid(previousHash) {
+		return errors.New("Block extends an invalid block")
+	}
+
+	// the longest chain already has a block at every height up to the checkpoint
+	if previousBlock.PathLength < chainState.CheckpointHeight() {
+		return errors.New("Block forks below the checkpoint")
+	}
+
+	if err := CheckBlockTarget(receivedBlock, previousBlock); err != nil {
+		return err
+	}
+
 	receivedBlock.PathLength = previousBlock.PathLength + 1
 	receivedBlock.PreviousBlock = previousBlock
-	receivedBlock.InkBank = previousBlock.TotalInkAmount
-	receivedBlock.TotalInkAmount = receivedBlock.InkBank + ComputeOpCostForMiner(receivedBlock.MinerPubKey, operations) // add any operations performed by the miner that generated this block
-	previousBlock.IsEndBlock = false
 
-	if len(operations) == 0 {
-		receivedBlock.TotalInkAmount = receivedBlock.TotalInkAmount + settings.InkPerNoOpBlock
-	} else {
-		receivedBlock.TotalInkAmount = receivedBlock.TotalInkAmount + settings.InkPerOpBlock
+	// applying the block to the state of the chain it extends checks its operations in order, so
+	// they can not conflict with each other or spend the same ink twice. Blocks without operations
+	// are applied as well: the chain they extend must be valid from the checkpoint on.
+	if err := chainState.WithChain(&receivedBlock, nil); err != nil {
+		return errors.New("Block does not apply to the chain it extends: " + err.Error())
 	}
 
-	blockList = append(blockList, receivedBlock)
-	globalChain = FindLongestBlockChain()
+	// After all validations pass, we append the block to the blockchain
 
-	SendBlockInfo(receivedBlock)
+	SaveBlock(&receivedBlock)
+	SetLongestChain(FindLongestChainTip())
 
 	return nil
 }
 
-func ExistInLocalBlockchain(blockHash string) bool {
-	for _, block := range blockList {
-		if blockHash == block.Hash {
-			return true
+// Checks the signature and contents of every operation in the block, without the chain. Pruned
+// operations are skipped, whether the block may carry them is checked by CheckPrunedHeight.
+func CheckBlockOperations(block Block) error {
+	for _, op := range block.SetOPs {
+		if op.Pruned {
+			continue
+		}
+		if !blockartlib.VerifyOperation(op) {
+			return errors.New("Failed to validate operation signature")
+		}
+		if err := CheckOperationContents(op); err != nil {
+			return errors.New("Block contains an invalid operation: " + err.Error())
 		}
 	}
 
-	return false
+	return nil
 }
 
-// returns a boolean true if hash contains specified number of zeroes num at the end
-func ComputeTrailingZeroes(hash string, numOfZero uint8) bool {
-	zeroString := strings.Repeat("0", int(numOfZero))
+// Checks that a block with pruned operations is at most at prunedHeight. Pruned operations are
+// only checked through their leaves, so they are only taken from a chain that is at least
+// CheckpointInterval blocks longer.
+func CheckPrunedHeight(block Block, parent *Block, prunedHeight int) error {
+	for _, op := range block.SetOPs {
+		if op.Pruned && parent.PathLength+1 > prunedHeight {
+			return errors.New("Block contains pruned operations")
+		}
+	}
+	return nil
+}
 
-	if strings.HasSuffix(hash, zeroString) {
-		return true
+// Checks that the block has a known version, and that its hash matches its header and the
+// header its operations. Operations that were pruned are checked through the fields they keep.
+func CheckBlockHeader(block Block) error {
+	if block.Version != blockartlib.BlockVersion {
+		return errors.New("Unknown block version " + strconv.Itoa(int(block.Version)))
 	}
-	return false
+
+	if ComputeBlockHash(block) != block.Hash {
+		return errors.New("Block hash does not match its contents")
+	}
+
+	if !bytes.Equal(blockartlib.MerkleRoot(block.SetOPs), block.MerkleRoot) {
+		return errors.New("Block operations do not match its header")
+	}
+
+	return nil
 }
 
-// checks that the previousHash in the block struct points to a previous generated block's Hash
-func CheckPreviousBlock(hash string) (*Block, bool) {
-	var blockPtr *Block
-	for i, block := range blockList {
-		if block.Hash == hash {
-			blockPtr = &blockList[i]
-			return blockPtr, true
-		}
+// Checks the header of the block and that its hash meets the target the block carries.
+// Whether it carries the right target is checked against its parent (see CheckBlockTarget).
+func CheckBlockHash(block Block) error {
+	if err := CheckBlockHeader(block); err != nil {
+		return err
 	}
-	return blockPtr, false
+
+	// Check if received block is a No-Op or Op block based on length of operations
+	return CheckProofOfWork(block, len(block.SetOPs) > 0)
 }
 
-// compute the total cost of operations for the current miner
-func ComputeOpCostForMiner(publicKey ecdsa.PublicKey, operations []Operation) uint32 {
-	var cost uint32
-	for _, op := range operations {
-		if reflect.DeepEqual(publicKey, op.ArtNodePubKey) {
-			if op.OpType == "Add" {
-				cost = cost - op.OpInkCost
-			}
-			// Fix delete by fixing DeleteShape's OpInkCost
+// Checks that the hash of the block meets the target it carries, scaled for Op blocks.
+func CheckProofOfWork(block Block, isOpBlock bool) error {
+	if block.Target == nil || block.Target.Sign() <= 0 || block.Target.Cmp(blockartlib.MaxTarget) > 0 {
+		return errors.New("Block has an invalid proof of work target")
+	}
+
+	if !blockartlib.HashMeetsTarget(block.Hash, blockartlib.BlockTarget(block.Target, isOpBlock, settings)) {
+		if !isOpBlock {
+			return errors.New("No-op block proof of work does not meet the target")
 		}
+		return errors.New("Op block proof of work does not meet the target")
 	}
 
-	return cost
+	return nil
 }
 
-// call this for op-blocks to validate the op-block
-func ValidateOperationForLongestChain(operation Operation, longestChain []Block) error {
+// Checks a block whose parent we do not have before it is pooled. Until the parent arrives its
+// hash can only be checked against the target it carries, so that target has to be one a chain
+// joining ours could call for (see MaxOrphanTarget).
+func CheckOrphanBlock(block Block) error {
+	if err := CheckBlockHash(block); err != nil {
+		return err
+	}
+
+	if block.Target.Cmp(MaxOrphanTarget()) > 0 {
+		return errors.New("Orphan block has an easier proof of work target than our chain allows")
+	}
 
-	// made a dummy private key but it should correspond to blockartlib shape added?
-	// need clarification from you guys
-	// Check that each operation in the block has a valid signature
+	return nil
+}
 
-	// CHECK THIS: DON'T THINK IT'S RIGHT
-	if !ecdsa.Verify(&operation.ArtNodePubKey, []byte("This is the private key!"), operation.OPSigR, operation.OPSigS) {
-		return errors.New("Failed to validate operation signature")
+// Returns the easiest base target a block that can still join our chains may carry: the target of
+// the checkpoint block, eased by MaxRetargetFactor for every retarget up to MaxOrphanBlocks blocks
+// above our longest chain. Without retargeting every block carries the checkpoint target.
+func MaxOrphanTarget() *big.Int {
+	tip := blockStore.Best()
+	checkpoint := blockStore.Genesis()
+	if height := chainState.CheckpointHeight(); height > 0 {
+		checkpoint = tip
+		for checkpoint.PathLength > height {
+			checkpoint = checkpoint.PreviousBlock
+		}
+	}
+
+	target := new(big.Int).Set(checkpoint.Target)
+	window := int(settings.RetargetWindow)
+	if settings.TargetBlockInterval == 0 || window == 0 {
+		return target
 	}
 
-	// Checks for DeleteShape
-	if operation.OpType == "Delete" {
+	retargets := (tip.PathLength+MaxOrphanBlocks-checkpoint.PathLength)/window + 1
+	for i := 0; i < retargets && target.Cmp(blockartlib.MaxTarget) < 0; i++ {
+		target.Mul(target, big.NewInt(blockartlib.MaxRetargetFactor))
+	}
+	if target.Cmp(blockartlib.MaxTarget) > 0 {
+		target.Set(blockartlib.MaxTarget)
+	}
 
-		DeleteConfirmed := false
-		for i := 0; i < len(longestChain); i++ {
+	return target
+}
 
-			for m := 0; m < len(longestChain[i].SetOPs); m++ {
-				if operation.DeleteUniqueID == longestChain[i].SetOPs[m].UniqueID {
-					DeleteConfirmed = true
-					return nil
-				}
-			}
+// Accepts the orphans waiting for the block, and in turn the orphans waiting for them, and sends
+// the ones that validate to our neighbours.
+func ConnectOrphans(hash string) {
+	for _, orphan := range orphanPool.TakeChildren(hash) {
+		if ExistInLocalBlockchain(orphan.Hash) {
+			continue
 		}
 
-		if DeleteConfirmed == false {
-			return blockartlib.ShapeOwnerError(operation.DeleteUniqueID)
+		if err := AcceptBlock(orphan); err != nil {
+			fmt.Println("Dropped orphan block " + orphan.Hash + ": " + err.Error())
+			continue
 		}
+
+		SendBlockInfo(orphan)
 	}
+}
 
-	// Checks for AddShape
-	if operation.OpType == "Add" {
-		// Validates the operation against duplicate signatures (UniqueID)
-		for j := 0; j < len(longestChain); j++ {
+// Requests the missing ancestors of an orphan from the miner that sent it, one block at a time,
+// until one of them connects to our block chain.
+func FetchAncestors(miner Miner, hash string) {
+	for i := 0; i < MaxOrphanBlocks; i++ {
+		if ExistInLocalBlockchain(hash) || orphanPool.Contains(hash) {
+			return
+		}
 
-			for k := 0; k < len(longestChain[j].SetOPs); k++ {
+		var blocks []Block
+		err := miner.Cli.Call("MinerKey.GetBlocks", []string{hash}, &blocks)
+		if err != nil || len(blocks) != 1 || blocks[0].Hash != hash {
+			return
+		}
+		block := blocks[0]
 
-				if operation.UniqueID == longestChain[j].SetOPs[k].UniqueID {
-					return blockartlib.ShapeOverlapError(operation.UniqueID)
-				}
+		if ExistInLocalBlockchain(block.PreviousHash) {
+			if err := AcceptBlock(block); err != nil {
+				fmt.Println("Dropped block " + block.Hash + ": " + err.Error())
+				return
 			}
+			SendBlockInfo(block)
+			return
 		}
 
-		// Validates the operation against the Ink Amount Check
-		for l := len(longestChain) - 1; l >= 0; l-- {
-			if reflect.DeepEqual(longestChain[l].MinerPubKey, operation.ArtNodePubKey) {
-				difference := int(longestChain[l].InkBank) - int(operation.OpInkCost)
-				if difference < 0 {
-					return blockartlib.InsufficientInkError(longestChain[l].InkBank)
-				}
-				break
-			}
+		if err := CheckOrphanBlock(block); err != nil {
+			return
+		}
+		orphanPool.Add(block)
+		hash = block.PreviousHash
+	}
+}
+
+// Returns a copy of the block without the link to its parent, so only the block itself is sent
+// over RPC.
+func UnlinkBlock(block Block) Block {
+	block.PreviousBlock = nil
+	return block
+}
+
+func ExistInLocalBlockchain(blockHash string) bool {
+	_, exists := blockStore.Get(blockHash)
+	return exists
+}
+
+// Checks that the block carries the target its parent calls for and that its timestamp is after
+// the median time of the blocks before it.
+func CheckBlockTarget(block Block, parent *Block) error {
+	if block.Target == nil || block.Target.Cmp(NextTarget(parent)) != 0 {
+		return errors.New("Block does not use the expected proof of work target")
+	}
+	if block.Timestamp <= MedianTimePast(parent) {
+		return errors.New("Block timestamp is not after the median time of the previous blocks")
+	}
+	return nil
+}
+
+// Returns the base target the children of parent have to carry. It is retargeted every
+// RetargetWindow blocks so that the window would have taken TargetBlockInterval per block.
+func NextTarget(parent *Block) *big.Int {
+	window := int(settings.RetargetWindow)
+	if settings.TargetBlockInterval == 0 || window == 0 || parent.PathLength%window != 0 {
+		return parent.Target
+	}
+
+	first := parent
+	for i := 0; i < window; i++ {
+		// the genesis block has no timestamp, the first window after it keeps its target
+		if first.PreviousBlock == nil || first.PreviousBlock.PreviousBlock == nil {
+			return parent.Target
+		}
+		first = first.PreviousBlock
+	}
+
+	return blockartlib.RetargetBase(parent.Target, parent.Timestamp-first.Timestamp, settings)
+}
+
+// Returns the median timestamp of the block and the blockartlib.MedianTimeBlocks - 1 blocks
+// before it.
+func MedianTimePast(block *Block) int64 {
+	timestamps := []int64{}
+	for ; block != nil && len(timestamps) < blockartlib.MedianTimeBlocks; block = block.PreviousBlock {
+		timestamps = append(timestamps, block.Timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// checks that the previousHash in the block struct points to a previous generated block's Hash
+func CheckPreviousBlock(hash string) (*Block, bool) {
+	return blockStore.Get(hash)
+}
+
+// Validates the operation against the chain the state was derived from.
+func ValidateOperation(operation Operation, state *ChainState) error {
+	// Check that the operation is signed by the art node that created it
+	if !blockartlib.VerifyOperation(operation) {
+		return errors.New("Failed to validate operation signature")
+	}
+
+	if err := CheckOperationContents(operation); err != nil {
+		return err
+	}
+
+	if err := CheckOperationExpiry(operation, time.Now().UnixNano()/int64(time.Millisecond)); err != nil {
+		return err
+	}
+
+	state.RLock()
+	defer state.RUnlock()
+
+	return state.checkOperation(operation)
+}
+
+// Checks that the operation can go in a block with the timestamp: it has not expired yet, and
+// does not expire more than MaxOperationLifetime later.
+func CheckOperationExpiry(operation Operation, timestamp int64) error {
+	if operation.Expires < timestamp {
+		return errors.New("Operation has expired")
+	}
+	if operation.Expires > timestamp+int64(blockartlib.MaxOperationLifetime/time.Millisecond) {
+		return errors.New("Operation expires too far in the future")
+	}
+	return nil
+}
+
+// Checks the parts of an operation that do not depend on the chain: for shapes, that the lines,
+// ink cost and svg element are the ones derived from the svg string.
+func CheckOperationContents(operation Operation) error {
+	switch operation.OpType {
+	case "Add":
+		if operation.ShapeType != blockartlib.PATH {
+			return blockartlib.InvalidShapeSvgStringError(operation.ShapeSvgString)
+		}
+
+		lines, ink, err := blockartlib.ParseShape(operation.ShapeSvgString, operation.Fill, operation.Stroke, settings.CanvasSettings)
+		if err != nil {
+			return err
+		}
+
+		pathShape := blockartlib.ConstructSvgString(operation.ShapeType, operation.ShapeSvgString, operation.Fill, operation.Stroke)
+		if ink != operation.OpInkCost || !reflect.DeepEqual(lines, operation.Lines) || pathShape != operation.PathShape {
+			return errors.New("Operation does not match its svg string")
+		}
+	case "Delete":
+		if operation.DeleteUniqueID == "" {
+			return blockartlib.InvalidShapeHashError(operation.DeleteUniqueID)
+		}
+	case "Reserve":
+		// checked against the canvas and the chain by ValidateReservation
+	default:
+		return errors.New("Unknown operation type " + operation.OpType)
+	}
+
+	return nil
+}
+
+// Returns the operations that can go in a block with the timestamp on top of prevBlock, in order,
+// leaving out the ones that are not valid on its chain or conflict with the operations before
+// them (including spending ink they already spent). Stops at MaxBlockOperations.
+func SelectValidOperations(prevBlock *Block, timestamp int64, operations []Operation) []Operation {
+	valid := []Operation{}
+
+	chainState.WithChain(prevBlock, func(state *ChainState) error {
+		candidate := &Block{PreviousHash: prevBlock.Hash, PreviousBlock: prevBlock, PathLength: prevBlock.PathLength + 1, MinerPubKey: pubKey, SetOPs: operations, Timestamp: timestamp}
+		delta := &BlockDelta{PrevBalances: make(map[string]uint32)}
+		state.creditReward(delta, candidate)
+
+		for _, op := range operations {
+			if len(valid) == MaxBlockOperations {
+				break
+			}
+			if err := CheckOperationExpiry(op, timestamp); err != nil {
+				continue
+			}
+			if err := state.checkOperation(op); err != nil {
+				continue
+			}
+			state.applyOperation(delta, op, candidate)
+			valid = append(valid, op)
+		}
+
+		state.undo(delta)
+		return nil
+	})
+
+	return valid
+}
+
+// CONNECTED MINERS
+
+func NewConnectedMiners() *ConnectedMiners {
+	return &ConnectedMiners{all: make(map[string]Miner)}
+}
+
+func (miners *ConnectedMiners) Add(miner Miner) {
+	miners.Lock()
+	defer miners.Unlock()
+
+	miners.all[miner.Address.String()] = miner
+}
+
+func (miners *ConnectedMiners) Remove(addr string) {
+	miners.Lock()
+	defer miners.Unlock()
+
+	delete(miners.all, addr)
+}
+
+func (miners *ConnectedMiners) Get(addr string) (Miner, bool) {
+	miners.RLock()
+	defer miners.RUnlock()
+
+	miner, exists := miners.all[addr]
+	return miner, exists
+}
+
+// Returns a copy of the connected miners by address, which RPCs can be made on without holding
+// the lock.
+func (miners *ConnectedMiners) All() map[string]Miner {
+	miners.RLock()
+	defer miners.RUnlock()
+
+	all := make(map[string]Miner, len(miners.all))
+	for addr, miner := range miners.all {
+		all[addr] = miner
+	}
+	return all
+}
+
+func (miners *ConnectedMiners) Len() int {
+	miners.RLock()
+	defer miners.RUnlock()
+
+	return len(miners.all)
+}
+
+// BLOCK STORE
+
+func NewBlockStore() *BlockStore {
+	return &BlockStore{
+		blocks:   make(map[string]*Block),
+		children: make(map[string][]string),
+		order:    []string{},
+		tips:     make(map[string]*Block),
+		invalid:  make(map[string]bool),
+	}
+}
+
+// Adds a block whose PreviousBlock is already set to the stored parent (nil for the genesis block).
+// Blocks that are already stored are ignored.
+func (store *BlockStore) Add(block *Block) {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, exists := store.blocks[block.Hash]; exists {
+		return
+	}
+
+	block.TotalWork = new(big.Int)
+	if block.PreviousBlock != nil {
+		block.TotalWork.Add(block.PreviousBlock.TotalWork, BlockWork(*block))
+	}
+
+	store.blocks[block.Hash] = block
+	store.order = append(store.order, block.Hash)
+
+	if block.PreviousBlock != nil {
+		store.children[block.PreviousHash] = append(store.children[block.PreviousHash], block.Hash)
+		if store.invalid[block.PreviousHash] {
+			store.invalid[block.Hash] = true
+			return
+		}
+		delete(store.tips, block.PreviousHash)
+	}
+
+	store.tips[block.Hash] = block
+	if store.best == nil || block.TotalWork.Cmp(store.best.TotalWork) > 0 {
+		store.best = block
+	}
+}
+
+// Marks the block and its descendants invalid. They stop being tips, and the parent becomes a tip
+// again once none of its children is valid. The best tip is picked again from the valid tips.
+func (store *BlockStore) MarkInvalid(hash string) {
+	store.Lock()
+	defer store.Unlock()
+
+	block, exists := store.blocks[hash]
+	if !exists || store.invalid[hash] {
+		return
+	}
+
+	pending := []string{hash}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		store.invalid[current] = true
+		delete(store.tips, current)
+		pending = append(pending, store.children[current]...)
+	}
+
+	if parent := block.PreviousBlock; parent != nil && !store.invalid[parent.Hash] {
+		hasValidChild := false
+		for _, child := range store.children[parent.Hash] {
+			if !store.invalid[child] {
+				hasValidChild = true
+			}
+		}
+		if !hasValidChild {
+			store.tips[parent.Hash] = parent
+		}
+	}
+
+	// going through the blocks in the order they were stored keeps the first one seen on a tie
+	store.best = nil
+	for _, stored := range store.order {
+		if tip, isTip := store.tips[stored]; isTip && (store.best == nil || tip.TotalWork.Cmp(store.best.TotalWork) > 0) {
+			store.best = tip
+		}
+	}
+}
+
+func (store *BlockStore) IsInvalid(hash string) bool {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.invalid[hash]
+}
+
+func (store *BlockStore) Get(hash string) (*Block, bool) {
+	store.RLock()
+	defer store.RUnlock()
+
+	block, exists := store.blocks[hash]
+	return block, exists
+}
+
+// Returns the hashes of the children of the block.
+func (store *BlockStore) Children(hash string) []string {
+	store.RLock()
+	defer store.RUnlock()
+
+	children := make([]string, len(store.children[hash]))
+	copy(children, store.children[hash])
+	return children
+}
+
+// Returns the valid tip of the chain with the most work.
+func (store *BlockStore) Best() *Block {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.best
+}
+
+// Returns the valid blocks that have no valid children yet.
+func (store *BlockStore) Tips() []*Block {
+	store.RLock()
+	defer store.RUnlock()
+
+	tips := make([]*Block, 0, len(store.tips))
+	for _, block := range store.tips {
+		tips = append(tips, block)
+	}
+	return tips
+}
+
+// Returns all blocks in the order they were added.
+func (store *BlockStore) All() []*Block {
+	store.RLock()
+	defer store.RUnlock()
+
+	blocks := make([]*Block, len(store.order))
+	for i, hash := range store.order {
+		blocks[i] = store.blocks[hash]
+	}
+	return blocks
+}
+
+func (store *BlockStore) Genesis() *Block {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.blocks[store.order[0]]
+}
+
+func (store *BlockStore) Len() int {
+	store.RLock()
+	defer store.RUnlock()
+
+	return len(store.order)
+}
+
+// ORPHAN POOL
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		byParent: make(map[string][]Block),
+		parents:  make(map[string]string),
+		order:    []string{},
+	}
+}
+
+func (pool *OrphanPool) Add(block Block) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if _, exists := pool.parents[block.Hash]; exists {
+		return
+	}
+
+	if len(pool.order) >= MaxOrphanBlocks {
+		pool.remove(pool.order[0])
+	}
+
+	pool.byParent[block.PreviousHash] = append(pool.byParent[block.PreviousHash], UnlinkBlock(block))
+	pool.parents[block.Hash] = block.PreviousHash
+	pool.order = append(pool.order, block.Hash)
+}
+
+func (pool *OrphanPool) Contains(hash string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	_, exists := pool.parents[hash]
+	return exists
+}
+
+// Removes and returns the orphans whose parent is the block with the given hash.
+func (pool *OrphanPool) TakeChildren(hash string) []Block {
+	pool.Lock()
+	defer pool.Unlock()
+
+	children := pool.byParent[hash]
+	for _, child := range children {
+		pool.remove(child.Hash)
+	}
+
+	return children
+}
+
+func (pool *OrphanPool) remove(hash string) {
+	parent := pool.parents[hash]
+	delete(pool.parents, hash)
+
+	siblings := pool.byParent[parent]
+	for i, sibling := range siblings {
+		if sibling.Hash == hash {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(pool.byParent, parent)
+	} else {
+		pool.byParent[parent] = siblings
+	}
+
+	for i, orphan := range pool.order {
+		if orphan == hash {
+			pool.order = append(pool.order[:i], pool.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// MEMPOOL
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		pending: make(map[string]MempoolEntry),
+		order:   []string{},
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Adds the operation unless it was seen already. Reports whether it was added.
+func (pool *Mempool) Add(op Operation) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if _, seen := pool.seen[op.UniqueID]; seen {
+		return false
+	}
+
+	pool.add(op)
+	return true
+}
+
+// Puts back an operation of a block that left the longest chain. It waits for a block as if it
+// had just arrived.
+func (pool *Mempool) Restore(op Operation) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if _, exists := pool.pending[op.UniqueID]; !exists {
+		pool.add(op)
+	}
+}
+
+func (pool *Mempool) Contains(uniqueID string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	_, exists := pool.pending[uniqueID]
+	return exists
+}
+
+func (pool *Mempool) Seen(uniqueID string) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	_, seen := pool.seen[uniqueID]
+	return seen
+}
+
+// Removes an operation that is on the longest chain.
+func (pool *Mempool) Remove(uniqueID string) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	delete(pool.pending, uniqueID)
+}
+
+// Returns the pending operations in the order they arrived, after dropping the expired ones.
+func (pool *Mempool) Pending() []Operation {
+	pool.Lock()
+	defer pool.Unlock()
+
+	pool.expire(time.Now())
+
+	ops := make([]Operation, 0, len(pool.order))
+	for _, uniqueID := range pool.order {
+		ops = append(ops, pool.pending[uniqueID].Op)
+	}
+	return ops
+}
+
+// Returns the number of operations added so far.
+func (pool *Mempool) Added() uint64 {
+	pool.Lock()
+	defer pool.Unlock()
+
+	return pool.added
+}
+
+func (pool *Mempool) add(op Operation) {
+	now := time.Now()
+	pool.seen[op.UniqueID] = now
+	pool.pending[op.UniqueID] = MempoolEntry{Op: op, Added: now}
+	pool.order = append(pool.order, op.UniqueID)
+	pool.added++
+
+	// the block being mined is rebuilt to include the operation
+	NotifyMiner()
+}
+
+// Drops the operations that waited longer than MempoolExpiry and the UniqueIDs seen longer than
+// SeenOperationExpiry ago, and the UniqueIDs of removed operations from order.
+func (pool *Mempool) expire(now time.Time) {
+	order := []string{}
+	listed := make(map[string]bool)
+	for _, uniqueID := range pool.order {
+		entry, exists := pool.pending[uniqueID]
+		if !exists || listed[uniqueID] {
+			continue
+		}
+		if now.Sub(entry.Added) > MempoolExpiry {
+			delete(pool.pending, uniqueID)
+			continue
+		}
+		listed[uniqueID] = true
+		order = append(order, uniqueID)
+	}
+	pool.order = order
+
+	for uniqueID, seenAt := range pool.seen {
+		if now.Sub(seenAt) > SeenOperationExpiry {
+			delete(pool.seen, uniqueID)
+		}
+	}
+}
+
+// OPERATION WATCH
+
+func NewOperationWatch() *OperationWatch {
+	return &OperationWatch{
+		watched: make(map[string]*WatchedOperation),
+		events:  []OwnedOperationEvent{},
+	}
+}
+
+// Starts watching an operation that was confirmed to the art node that signed it.
+func (watch *OperationWatch) Watch(op Operation) {
+	watch.Lock()
+	defer watch.Unlock()
+
+	watched := &WatchedOperation{
+		Op:        op,
+		Owner:     PubKeyToString(op.ArtNodePubKey),
+		BlockHash: chainState.OperationBlock(op.UniqueID),
+	}
+	watch.watched[op.UniqueID] = watched
+
+	// confirmed on a fork that is not the longest chain, it has to be mined again
+	if watched.BlockHash == "" {
+		mempool.Restore(op)
+	}
+}
+
+// Checks the watched operations against the longest chain after it changed. An operation whose
+// block left the chain goes back to the mempool (OpDropped) if it is still valid on the new chain,
+// and is given up on otherwise (OpInvalidated), as it is when it expires from the mempool. An
+// operation that is on the chain again is OpReincluded.
+func (watch *OperationWatch) Update() {
+	watch.Lock()
+	defer watch.Unlock()
+
+	tipHeight := 0
+	if tip, exists := blockStore.Get(chainState.TipHash()); exists {
+		tipHeight = tip.PathLength
+	}
+
+	checkpointHeight := chainState.CheckpointHeight()
+
+	for uniqueID, watched := range watch.watched {
+		// the block can no longer leave the chain, and the chain state may forget it
+		if block, exists := blockStore.Get(watched.BlockHash); exists && block.PathLength <= checkpointHeight {
+			delete(watch.watched, uniqueID)
+			continue
+		}
+
+		blockHash := chainState.OperationBlock(uniqueID)
+
+		switch {
+		case watched.BlockHash != "" && blockHash == "":
+			if err := ValidateOperation(watched.Op, chainState); err != nil {
+				mempool.Remove(uniqueID)
+				watch.emit(watched, blockartlib.OperationEvent{Type: blockartlib.OpInvalidated, Reason: err.Error()})
+				delete(watch.watched, uniqueID)
+				continue
+			}
+
+			mempool.Restore(watched.Op)
+			watched.BlockHash = ""
+			watch.emit(watched, blockartlib.OperationEvent{Type: blockartlib.OpDropped})
+
+		case blockHash != "" && blockHash != watched.BlockHash:
+			// on the chain again, or in another block of the new chain
+			watched.BlockHash = blockHash
+			watch.emit(watched, blockartlib.OperationEvent{Type: blockartlib.OpReincluded, BlockHash: blockHash})
+
+		case blockHash == "" && !mempool.Contains(uniqueID):
+			watch.emit(watched, blockartlib.OperationEvent{Type: blockartlib.OpInvalidated, Reason: "Expired from the mempool"})
+			delete(watch.watched, uniqueID)
+			continue
+		}
+
+		if block, exists := blockStore.Get(blockHash); exists && tipHeight-block.PathLength >= WatchedOperationDepth {
+			delete(watch.watched, uniqueID)
+		}
+	}
+}
+
+// Returns the events of the operations of the owner that come after the event numbered since.
+func (watch *OperationWatch) Events(owner string, since uint64) []blockartlib.OperationEvent {
+	watch.Lock()
+	defer watch.Unlock()
+
+	events := []blockartlib.OperationEvent{}
+	for _, owned := range watch.events {
+		if owned.Owner == owner && owned.Event.Seq > since {
+			events = append(events, owned.Event)
+		}
+	}
+	return events
+}
+
+func (watch *OperationWatch) emit(watched *WatchedOperation, event blockartlib.OperationEvent) {
+	watch.seq++
+	event.Seq = watch.seq
+	event.OpHash = watched.Op.UniqueID
+
+	if len(watch.events) >= MaxOperationEvents {
+		watch.events = watch.events[1:]
+	}
+	watch.events = append(watch.events, OwnedOperationEvent{Owner: watched.Owner, Event: event})
+
+	fmt.Println("Confirmed operation " + event.Type + ": " + event.OpHash)
+}
+
+// CHAIN STATE
+
+func NewChainState() *ChainState {
+	return &ChainState{
+		Balances:     make(map[string]uint32),
+		Shapes:       make(map[string]Operation),
+		Owners:       make(map[string]string),
+		OpBlocks:     make(map[string]string),
+		Reservations: make(map[string]Reservation),
+		deltas:       []*BlockDelta{},
+		keptShapes:   make(map[string]bool),
+	}
+}
+
+func (state *ChainState) TipHash() string {
+	state.RLock()
+	defer state.RUnlock()
+
+	return state.Tip
+}
+
+func (state *ChainState) Balance(key ecdsa.PublicKey) uint32 {
+	state.RLock()
+	defer state.RUnlock()
+
+	return state.Balances[PubKeyToString(key)]
+}
+
+func (state *ChainState) CheckpointHeight() int {
+	state.RLock()
+	defer state.RUnlock()
+
+	if state.Checkpoint == nil {
+		return 0
+	}
+	return state.Checkpoint.Height
+}
+
+// Makes the checkpoint the lowest block the state can be moved back to, dropping the undo
+// information and the expired reservations below it.
+func (state *ChainState) SetCheckpoint(checkpoint *Checkpoint) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.Checkpoint = checkpoint
+
+	for i, delta := range state.deltas {
+		if delta.Hash == checkpoint.Hash {
+			state.deltas = append([]*BlockDelta{}, state.deltas[i+1:]...)
+			break
+		}
+	}
+
+	for uniqueID, reservation := range state.Reservations {
+		if reservation.Height+reservation.Op.ReserveBlocks <= checkpoint.Height {
+			delete(state.Reservations, uniqueID)
+		}
+	}
+}
+
+// Forgets the blocks of the operations that can no longer be replayed. Every block after the
+// checkpoint is timestamped after the median time past of the checkpoint block, so the operations
+// of a block more than MaxOperationLifetime older than that have expired for all of them (see
+// CheckOperationExpiry). Live shapes keep their blocks, which their proofs are built from.
+func (state *ChainState) ForgetExpiredOperations(checkpoint *Block) {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.Checkpoint == nil || state.Checkpoint.Hash != checkpoint.Hash {
+		return
+	}
+
+	// shapes deleted at or below the checkpoint can not come back
+	for uniqueID := range state.keptShapes {
+		if _, live := state.Checkpoint.Shapes[uniqueID]; !live {
+			delete(state.OpBlocks, uniqueID)
+			delete(state.keptShapes, uniqueID)
+		}
+	}
+
+	cutoff := MedianTimePast(checkpoint) - int64(blockartlib.MaxOperationLifetime/time.Millisecond)
+
+	blocks := []*Block{}
+	for block := checkpoint; block != nil && block.PathLength > state.forgottenHeight; block = block.PreviousBlock {
+		blocks = append(blocks, block)
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		// timestamps are not in order; the blocks from the first one that is too new on are
+		// looked at again at the next checkpoint
+		if block.PreviousBlock != nil && block.Timestamp > cutoff {
+			break
+		}
+
+		for _, op := range block.SetOPs {
+			if _, live := state.Checkpoint.Shapes[op.UniqueID]; live {
+				state.keptShapes[op.UniqueID] = true
+				continue
+			}
+			delete(state.OpBlocks, op.UniqueID)
+		}
+		state.forgottenHeight = block.PathLength
+	}
+}
+
+// Returns the hash of the block containing the operation, or "" if it is not on the chain.
+func (state *ChainState) OperationBlock(uniqueID string) string {
+	state.RLock()
+	defer state.RUnlock()
+
+	return state.OpBlocks[uniqueID]
+}
+
+// Moves the state to the chain ending in tip: the blocks after the common ancestor are reverted
+// and the blocks of the new branch applied. If a block cannot be applied the state is moved back
+// to where it was and the error is returned.
+func (state *ChainState) SwitchTo(tip *Block) error {
+	state.Lock()
+	defer state.Unlock()
+
+	return state.switchTo(tip)
+}
+
+// Moves the state to the chain ending in tip for as long as check runs, and back to where it was
+// afterwards, so only the blocks after the fork are reverted and applied twice. The state stays
+// locked, readers never see it on the other chain. A nil check only tests that the chain can be
+// applied. Returns the error of the switch or of check.
+func (state *ChainState) WithChain(tip *Block, check func(state *ChainState) error) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldTip, _ := blockStore.Get(state.Tip)
+	if err := state.switchTo(tip); err != nil {
+		return err
+	}
+
+	var err error
+	if check != nil {
+		err = check(state)
+	}
+
+	// the block being checked is not stored yet, the fork with the old chain is found from its parent
+	for len(state.deltas) > 0 {
+		if _, stored := blockStore.Get(state.Tip); stored {
+			break
+		}
+		state.revertTip()
+	}
+
+	// the old chain was applied before, so switching back can not fail
+	if oldTip != nil {
+		state.switchTo(oldTip)
+	} else {
+		for len(state.deltas) > 0 {
+			state.revertTip()
+		}
+	}
+
+	return err
+}
+
+// The caller holds the lock.
+func (state *ChainState) switchTo(tip *Block) error {
+	if state.Tip == tip.Hash {
+		return nil
+	}
+
+	oldTip, _ := blockStore.Get(state.Tip)
+
+	// walk back from both ends until the common ancestor is found
+	ancestor := oldTip
+	branch := []*Block{}
+	for block := tip; ancestor == nil || block.Hash != ancestor.Hash; {
+		if ancestor != nil && ancestor.PathLength >= block.PathLength {
+			ancestor = ancestor.PreviousBlock
+			continue
+		}
+		branch = append(branch, block)
+		if block.PreviousBlock == nil {
+			// the state is empty (ancestor == nil), the new branch starts at the genesis block
+			break
+		}
+		block = block.PreviousBlock
+	}
+
+	if state.Checkpoint != nil && ancestor != nil && ancestor.PathLength < state.Checkpoint.Height {
+		err := errors.New("Chain forks below the checkpoint at height " + strconv.Itoa(state.Checkpoint.Height))
+		return InvalidBlockError{Hash: branch[len(branch)-1].Hash, Err: err}
+	}
+
+	reverted := []*Block{}
+	for ancestor != nil && state.Tip != ancestor.Hash {
+		block, _ := blockStore.Get(state.Tip)
+		state.revertTip()
+		reverted = append(reverted, block)
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		if err := state.apply(branch[i]); err != nil {
+			// undo the part of the branch that was applied and restore the old chain
+			for state.Tip != ancestorHash(ancestor) {
+				state.revertTip()
+			}
+			for j := len(reverted) - 1; j >= 0; j-- {
+				state.apply(reverted[j])
+			}
+			return InvalidBlockError{Hash: branch[i].Hash, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func ancestorHash(ancestor *Block) string {
+	if ancestor == nil {
+		return ""
+	}
+	return ancestor.Hash
+}
+
+// Applies the block on top of the state's tip and records the changes as a BlockDelta.
+// Nothing is changed if the block is invalid for the state.
+func (state *ChainState) apply(block *Block) error {
+	delta := &BlockDelta{
+		Hash:         block.Hash,
+		PreviousHash: block.PreviousHash,
+		PrevBalances: make(map[string]uint32),
+	}
+
+	state.creditReward(delta, block)
+
+	for _, op := range block.SetOPs {
+		// the shapes of the genesis block are placed as configured
+		if block.PreviousBlock != nil {
+			if err := CheckOperationExpiry(op, block.Timestamp); err != nil {
+				state.undo(delta)
+				return err
+			}
+			if err := state.checkOperation(op); err != nil {
+				state.undo(delta)
+				return err
+			}
+		}
+		state.applyOperation(delta, op, block)
+	}
+
+	state.Tip = block.Hash
+	state.Height = block.PathLength
+	state.deltas = append(state.deltas, delta)
+
+	return nil
+}
+
+// Credits the mining reward of the block to its miner, or the genesis allocations for the
+// genesis block.
+func (state *ChainState) creditReward(delta *BlockDelta, block *Block) {
+	if block.PreviousBlock == nil {
+		for key, ink := range genesisAllocations {
+			state.setBalance(delta, key, state.Balances[key]+ink)
+		}
+		return
+	}
+
+	minerKey := PubKeyToString(block.MinerPubKey)
+	reward := settings.InkPerNoOpBlock
+	if len(block.SetOPs) > 0 {
+		reward = settings.InkPerOpBlock
+	}
+	state.setBalance(delta, minerKey, state.Balances[minerKey]+reward)
+}
+
+// Checks the operation against the state: it is not on the chain yet, a deleted shape is live and
+// owned by the same key, and an added shape or reservation is paid for and does not conflict with
+// the shapes and reservations of other keys. The caller holds the lock.
+func (state *ChainState) checkOperation(operation Operation) error {
+	// Validates the operation against duplicate signatures (UniqueID)
+	if _, exists := state.OpBlocks[operation.UniqueID]; exists {
+		return blockartlib.ShapeOverlapError(operation.UniqueID)
+	}
+
+	switch operation.OpType {
+	case "Delete":
+		// only the owner of a live shape can delete it
+		if owner, exists := state.Owners[operation.DeleteUniqueID]; !exists || owner != PubKeyToString(operation.ArtNodePubKey) {
+			return blockartlib.ShapeOwnerError(operation.DeleteUniqueID)
+		}
+		return nil
+	case "Add", "Reserve":
+		// Validates the operation against the Ink Amount Check
+		ink := state.Balances[PubKeyToString(operation.ArtNodePubKey)]
+		if ink < operation.OpInkCost {
+			return blockartlib.InsufficientInkError(ink)
+		}
+
+		if operation.OpType == "Reserve" {
+			return ValidateReservation(operation, state)
+		}
+
+		// the lines of a pruned shape are gone; it was checked against the canvas when its block
+		// was accepted
+		if operation.Pruned {
+			return nil
+		}
+
+		if err := CheckReservations(operation, state); err != nil {
+			return err
+		}
+		return CheckIntersection(operation, state)
+	}
+
+	return errors.New("Unknown operation type " + operation.OpType)
+}
+
+// Applies an operation that passed checkOperation, recording the changes in the delta.
+func (state *ChainState) applyOperation(delta *BlockDelta, op Operation, block *Block) {
+	state.OpBlocks[op.UniqueID] = block.Hash
+	delta.Ops = append(delta.Ops, op.UniqueID)
+
+	opKey := PubKeyToString(op.ArtNodePubKey)
+
+	switch op.OpType {
+	case "Add", "Reserve":
+		state.setBalance(delta, opKey, state.Balances[opKey]-op.OpInkCost)
+
+		if op.OpType == "Add" {
+			state.Shapes[op.UniqueID] = op
+			state.Owners[op.UniqueID] = opKey
+			delta.AddedShapes = append(delta.AddedShapes, op.UniqueID)
+		} else {
+			state.Reservations[op.UniqueID] = Reservation{Op: op, Height: block.PathLength}
+			delta.Reservations = append(delta.Reservations, op.UniqueID)
+		}
+	case "Delete":
+		if shape, exists := state.Shapes[op.DeleteUniqueID]; exists {
+			// the ink of a deleted shape goes back to its owner
+			owner := state.Owners[op.DeleteUniqueID]
+			state.setBalance(delta, owner, state.Balances[owner]+shape.OpInkCost)
+
+			delta.DeletedShapes = append(delta.DeletedShapes, shape)
+			delete(state.Shapes, op.DeleteUniqueID)
+			delete(state.Owners, op.DeleteUniqueID)
+		}
+	}
+}
+
+// Reverts the last block applied, moving the tip back to its parent.
+func (state *ChainState) revertTip() {
+	delta := state.deltas[len(state.deltas)-1]
+	state.deltas = state.deltas[:len(state.deltas)-1]
+
+	state.undo(delta)
+	state.Tip = delta.PreviousHash
+	state.Height = state.Height - 1
+}
+
+// Undoes the changes recorded in the delta, in reverse order.
+func (state *ChainState) undo(delta *BlockDelta) {
+	for _, uniqueID := range delta.Reservations {
+		delete(state.Reservations, uniqueID)
+	}
+	for i := len(delta.DeletedShapes) - 1; i >= 0; i-- {
+		shape := delta.DeletedShapes[i]
+		state.Shapes[shape.UniqueID] = shape
+		state.Owners[shape.UniqueID] = PubKeyToString(shape.ArtNodePubKey)
+	}
+	for _, shapeHash := range delta.AddedShapes {
+		delete(state.Shapes, shapeHash)
+		delete(state.Owners, shapeHash)
+	}
+	for _, uniqueID := range delta.Ops {
+		delete(state.OpBlocks, uniqueID)
+	}
+	for key, ink := range delta.PrevBalances {
+		state.Balances[key] = ink
+	}
+	for _, key := range delta.NewKeys {
+		delete(state.Balances, key)
+	}
+}
+
+// Sets the balance of the key, recording its previous balance in the delta the first time.
+func (state *ChainState) setBalance(delta *BlockDelta, key string, ink uint32) {
+	_, recorded := delta.PrevBalances[key]
+	isNew := false
+	for _, newKey := range delta.NewKeys {
+		if newKey == key {
+			isNew = true
+		}
+	}
+
+	if !recorded && !isNew {
+		if prev, exists := state.Balances[key]; exists {
+			delta.PrevBalances[key] = prev
+		} else {
+			delta.NewKeys = append(delta.NewKeys, key)
+		}
+	}
+
+	state.Balances[key] = ink
+}
+
+// Returns the key as a string that can be used as a map key.
+func PubKeyToString(key ecdsa.PublicKey) string {
+	if key.Curve == nil || key.X == nil || key.Y == nil {
+		return ""
+	}
+	return hex.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// Adds the block to the block store and appends it to the chain file.
+func SaveBlock(block *Block) {
+	if ExistInLocalBlockchain(block.Hash) {
+		return
+	}
+
+	blockStore.Add(block)
+
+	if chainFile != nil {
+		HandleError(chainFile.Append(*block))
+	}
+}
+
+// CHAIN FILE
+
+// Opens the chain file in dir and returns the blocks read from it with their offsets. A truncated or corrupt tail
+// (left behind by a crash during a write) is cut off, and the index is rebuilt if it does not
+// match the blocks that were read.
+func OpenChainFile(dir string) (*ChainFile, []Block, []int64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, nil, err
+	}
+
+	blocksFile, err := os.OpenFile(filepath.Join(dir, "blocks.dat"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	indexFile, err := os.OpenFile(filepath.Join(dir, "blocks.idx"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		blocksFile.Close()
+		return nil, nil, nil, err
+	}
+
+	file := &ChainFile{blocks: blocksFile, index: indexFile}
+
+	blocks, offsets, err := file.readBlocks()
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	if err := file.checkIndex(blocks, offsets); err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	return file, blocks, offsets, nil
+}
+
+// Reads every valid record, truncates the file after the last one and returns the blocks along
+// with their offsets.
+func (file *ChainFile) readBlocks() ([]Block, []int64, error) {
+	if _, err := file.blocks.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(file.blocks)
+	blocks := []Block{}
+	offsets := []int64{}
+	offset := int64(0)
+
+	for {
+		block, size, err := readBlockRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("Chain file: dropping corrupt tail at offset %d (%s)\n", offset, err.Error())
+			break
+		}
+
+		blocks = append(blocks, block)
+		offsets = append(offsets, offset)
+		offset = offset + size
+	}
+
+	if err := file.truncate(offset); err != nil {
+		return nil, nil, err
+	}
+
+	return blocks, offsets, nil
+}
+
+// Cuts the block file off at offset, dropping everything written after it.
+func (file *ChainFile) truncate(offset int64) error {
+	if err := file.blocks.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := file.blocks.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	file.offset = offset
+	return nil
+}
+
+// Rewrites the index unless it lists exactly the given blocks at the given offsets.
+func (file *ChainFile) checkIndex(blocks []Block, offsets []int64) error {
+	if _, err := file.index.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file.index)
+	matches := true
+	i := 0
+	for scanner.Scan() {
+		if i >= len(blocks) || scanner.Text() != indexEntry(blocks[i].Hash, offsets[i]) {
+			matches = false
+			break
+		}
+		i++
+	}
+
+	if matches && i == len(blocks) && scanner.Err() == nil {
+		_, err := file.index.Seek(0, io.SeekEnd)
+		return err
+	}
+
+	fmt.Println("Chain file: rebuilding block index")
+
+	if err := file.index.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.index.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file.index)
+	for i := range blocks {
+		writer.WriteString(indexEntry(blocks[i].Hash, offsets[i]) + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	return file.index.Sync()
+}
+
+// Appends the block to the end of the block file and its offset to the index.
+func (file *ChainFile) Append(block Block) error {
+	file.Lock()
+	defer file.Unlock()
+
+	record, err := encodeBlockRecord(block)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.blocks.Write(record); err != nil {
+		// leave no partial record behind for the next append
+		file.truncate(file.offset)
+		return err
+	}
+	if err := file.blocks.Sync(); err != nil {
+		return err
+	}
+
+	offset := file.offset
+	file.offset = file.offset + int64(len(record))
+
+	if _, err := file.index.WriteString(indexEntry(block.Hash, offset) + "\n"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (file *ChainFile) Close() {
+	file.blocks.Close()
+	file.index.Close()
+}
+
+func indexEntry(hash string, offset int64) string {
+	return hash + " " + strconv.FormatInt(offset, 10)
+}
+
+// Encodes the block as a length and checksum prefixed record. PreviousBlock is left out, it is
+// linked again through PreviousHash on replay.
+func encodeBlockRecord(block Block) ([]byte, error) {
+	block.PreviousBlock = nil
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(block); err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, 8+payload.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	copy(record[8:], payload.Bytes())
+
+	return record, nil
+}
+
+// Reads one record, returning io.EOF only if the reader is exactly at the end of the file.
+func readBlockRecord(reader io.Reader) (Block, int64, error) {
+	var block Block
+
+	header := make([]byte, 8)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return block, 0, io.EOF
+		}
+		return block, 0, errors.New("truncated record header")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return block, 0, errors.New("truncated record")
+	}
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return block, 0, errors.New("checksum mismatch")
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&block); err != nil {
+		return block, 0, err
+	}
+
+	return block, int64(8 + length), nil
+}
+
+// Adds the blocks read from the chain file to the block store. Every block is checked like a block
+// received from another miner (see AcceptBlock and ConnectBlock): it links to a known parent, its
+// hash, proof of work and operations are valid, and it applies to the chain it extends. Returns
+// the number of blocks accepted; the file is cut off at the first block that fails.
+func ReplayChainFile(file *ChainFile, blocks []Block, offsets []int64) (int, error) {
+	// blocks synced from a pruning miner carry pruned operations up to its checkpoint, which is
+	// below the checkpoint of the longest chain in the file. Only headers whose work checks out
+	// count towards the height of that chain.
+	genesis := blockStore.Genesis()
+	headers := map[string]*Block{genesis.Hash: genesis}
+	maxHeight := genesis.PathLength
+	for _, block := range blocks {
+		parent, exists := headers[block.PreviousHash]
+		if !exists {
+			continue
+		}
+
+		header := HeaderBlock(HeaderOf(block), block.Hash, parent)
+		if CheckHeaderWork(header) != nil {
+			continue
+		}
+		headers[block.Hash] = header
+		if header.PathLength > maxHeight {
+			maxHeight = header.PathLength
+		}
+	}
+	prunedHeight := PrunedHeightAt(maxHeight)
+
+	for i := range blocks {
+		block := blocks[i]
+
+		if err := ReplayBlock(&block, prunedHeight); err != nil {
+			fmt.Printf("Chain file: block %s failed verification (%s), dropping it and the blocks after it\n", block.Hash, err.Error())
+			return i, file.truncateFrom(offsets[i])
+		}
+	}
+
+	return len(blocks), nil
+}
+
+// Checks a block read from the chain file and stores it. The chain state is moved onto the block,
+// so the blocks of one chain, which the file holds in order, are applied one at a time. The block
+// may carry pruned operations if it is at most at prunedHeight.
+func ReplayBlock(block *Block, prunedHeight int) error {
+	parent, exists := blockStore.Get(block.PreviousHash)
+	if !exists {
+		return errors.New("Failed to validate hash of a previous block")
+	}
+
+	if err := CheckBlockHash(*block); err != nil {
+		return err
+	}
+	if err := CheckPrunedHeight(*block, parent, prunedHeight); err != nil {
+		return err
+	}
+	if err := CheckBlockOperations(*block); err != nil {
+		return err
+	}
+	if err := CheckBlockTarget(*block, parent); err != nil {
+		return err
+	}
+
+	block.PreviousBlock = parent
+	block.PathLength = parent.PathLength + 1
+	if err := chainState.SwitchTo(block); err != nil {
+		return err
+	}
+
+	// the state's tip is the block now, it is stored before the next block is switched to
+	blockStore.Add(block)
+	return nil
+}
+
+// Drops the records from offset onwards and rebuilds the index for the records before it.
+func (file *ChainFile) truncateFrom(offset int64) error {
+	if err := file.truncate(offset); err != nil {
+		return err
+	}
+
+	blocks, offsets, err := file.readBlocks()
+	if err != nil {
+		return err
+	}
+
+	return file.checkIndex(blocks, offsets)
+}
+
+// Returns the target the hash of the block has to meet, derived from the base target it carries.
+func RequiredTarget(block Block) *big.Int {
+	return blockartlib.BlockTarget(block.Target, len(block.SetOPs) > 0, settings)
+}
+
+// Returns the expected number of hashes needed to mine the block.
+func BlockWork(block Block) *big.Int {
+	return blockartlib.TargetWork(RequiredTarget(block))
+}
+
+// CHAIN EXPORT
+
+// Writes the blocks of the chain file in dir as JSON (see blockartlib.ChainExport).
+// Usage: go run ink-miner.go export -data-dir [data dir] [-out chain.json]
+func ExportChain(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "", "directory the blockchain is stored in")
+	out := flags.String("out", "", "file to write the chain to (default stdout)")
+	flags.Parse(args)
+
+	if *dataDir == "" {
+		return errors.New("-data-dir is required")
+	}
+	if _, err := os.Stat(*dataDir); err != nil {
+		return err
+	}
+
+	file, blocks, _, err := OpenChainFile(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chain := blockartlib.ChainExport{Version: blockartlib.ChainExportVersion, Blocks: []blockartlib.ExportedBlock{}}
+	heights := make(map[string]int)
+	for _, block := range blocks {
+		if len(chain.Blocks) == 0 {
+			// parents are written before their children, so the first block extends the genesis block
+			chain.GenesisBlockHash = block.PreviousHash
+			heights[block.PreviousHash] = 1
+		}
+
+		parentHeight, exists := heights[block.PreviousHash]
+		if !exists {
+			return errors.New("Block " + block.Hash + " is stored before its parent")
+		}
+		heights[block.Hash] = parentHeight + 1
+
+		chain.Blocks = append(chain.Blocks, ExportBlock(block, parentHeight+1))
+	}
+
+	writer := os.Stdout
+	if *out != "" {
+		outFile, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer outFile.Close()
+		writer = outFile
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(chain)
+}
+
+// Appends the blocks of an exported chain that are not stored yet to the chain file in dir. Only
+// the hashes are checked here: the settings of the network are not known until the miner starts.
+// The miner replays the file through the same checks as blocks from other miners when it starts,
+// and cuts the file off at the first block that fails them.
+// Usage: go run ink-miner.go import -data-dir [data dir] -in chain.json
+func ImportChain(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "", "directory the blockchain is stored in")
+	in := flags.String("in", "", "file to read the chain from")
+	flags.Parse(args)
+
+	if *dataDir == "" || *in == "" {
+		return errors.New("-data-dir and -in are required")
+	}
+
+	chain, err := blockartlib.ReadChainExport(*in)
+	if err != nil {
+		return err
+	}
+
+	file, storedBlocks, _, err := OpenChainFile(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if len(storedBlocks) > 0 && storedBlocks[0].PreviousHash != chain.GenesisBlockHash {
+		return errors.New("The chain does not have the same genesis block as the stored chain")
+	}
+
+	known := map[string]bool{chain.GenesisBlockHash: true}
+	for _, block := range storedBlocks {
+		known[block.Hash] = true
+	}
+
+	imported := 0
+	for _, exported := range chain.Blocks {
+		if known[exported.Hash] {
+			continue
+		}
+
+		block, err := ImportBlock(exported)
+		if err != nil {
+			return err
+		}
+		if err := CheckBlockHeader(block); err != nil {
+			return errors.New(err.Error() + ": " + block.Hash)
+		}
+
+		if err := file.Append(block); err != nil {
+			return err
+		}
+		known[block.Hash] = true
+		imported++
+	}
+
+	fmt.Printf("Imported %d blocks into %s\n", imported, *dataDir)
+	return nil
+}
+
+func ExportBlock(block Block, height int) blockartlib.ExportedBlock {
+	exported := blockartlib.ExportedBlock{
+		Hash:         block.Hash,
+		Version:      block.Version,
+		PreviousHash: block.PreviousHash,
+		Height:       height,
+		MerkleRoot:   hex.EncodeToString(block.MerkleRoot),
+		Nonce:        block.Nonce,
+		ExtraNonce:   block.ExtraNonce,
+		Timestamp:    block.Timestamp,
+		MinerPubKey:  blockartlib.EncodePublicKey(block.MinerPubKey),
+		Operations:   []blockartlib.ExportedOperation{},
+	}
+	if block.Target != nil {
+		exported.Target = block.Target.Text(16)
+	}
+
+	for _, op := range block.SetOPs {
+		exportedOp := blockartlib.ExportedOperation{
+			UniqueID:        op.UniqueID,
+			OpType:          op.OpType,
+			ShapeType:       op.ShapeType,
+			ArtNodeID:       op.ArtNodeID,
+			ArtNodePubKey:   blockartlib.EncodePublicKey(op.ArtNodePubKey),
+			ValidateNum:     op.ValidateNum,
+			InkCost:         op.OpInkCost,
+			Expires:         op.Expires,
+			SvgString:       op.ShapeSvgString,
+			Fill:            op.Fill,
+			Stroke:          op.Stroke,
+			DeleteShapeHash: op.DeleteUniqueID,
+			Pruned:          op.Pruned,
+		}
+		if op.Pruned {
+			exportedOp.BodyHash = hex.EncodeToString(op.BodyHash)
+		}
+		if op.OPSigR != nil && op.OPSigS != nil {
+			exportedOp.SignatureR = op.OPSigR.Text(16)
+			exportedOp.SignatureS = op.OPSigS.Text(16)
+		}
+		if op.OpType == "Reserve" {
+			region := blockartlib.Rect(op.Region)
+			exportedOp.Region = &region
+			exportedOp.ReserveBlocks = op.ReserveBlocks
+		}
+
+		exported.Operations = append(exported.Operations, exportedOp)
+	}
+
+	return exported
+}
+
+// Converts an exported block back, recomputing the fields of its operations that are derived
+// from the svg string.
+func ImportBlock(exported blockartlib.ExportedBlock) (Block, error) {
+	minerPubKey, err := blockartlib.ParsePublicKey(exported.MinerPubKey)
+	if err != nil {
+		return Block{}, err
+	}
+
+	target, ok := new(big.Int).SetString(exported.Target, 16)
+	if !ok {
+		return Block{}, errors.New("Bad target in block " + exported.Hash)
+	}
+
+	merkleRoot, err := hex.DecodeString(exported.MerkleRoot)
+	if err != nil {
+		return Block{}, errors.New("Bad Merkle root in block " + exported.Hash)
+	}
+
+	block := Block{
+		Hash:         exported.Hash,
+		Version:      exported.Version,
+		PreviousHash: exported.PreviousHash,
+		MerkleRoot:   merkleRoot,
+		Nonce:        exported.Nonce,
+		ExtraNonce:   exported.ExtraNonce,
+		Timestamp:    exported.Timestamp,
+		Target:       target,
+		MinerPubKey:  minerPubKey,
+		PathLength:   exported.Height,
+	}
+
+	for _, exportedOp := range exported.Operations {
+		artNodePubKey, err := blockartlib.ParsePublicKey(exportedOp.ArtNodePubKey)
+		if err != nil {
+			return Block{}, err
+		}
+
+		op := Operation{
+			ArtNodeID:      exportedOp.ArtNodeID,
+			ShapeType:      exportedOp.ShapeType,
+			UniqueID:       exportedOp.UniqueID,
+			ArtNodePubKey:  artNodePubKey,
+			ValidateNum:    exportedOp.ValidateNum,
+			ShapeSvgString: exportedOp.SvgString,
+			Fill:           exportedOp.Fill,
+			Stroke:         exportedOp.Stroke,
+			OpInkCost:      exportedOp.InkCost,
+			OpType:         exportedOp.OpType,
+			DeleteUniqueID: exportedOp.DeleteShapeHash,
+			ReserveBlocks:  exportedOp.ReserveBlocks,
+			Expires:        exportedOp.Expires,
+			Pruned:         exportedOp.Pruned,
+		}
+
+		if op.Pruned {
+			op.BodyHash, err = hex.DecodeString(exportedOp.BodyHash)
+			if err != nil {
+				return Block{}, errors.New("Bad leaf in block " + exported.Hash)
+			}
+		} else {
+			op.OPSigR, op.OPSigS, err = exportedOp.Signature()
+			if err != nil {
+				return Block{}, err
+			}
+		}
+		if exportedOp.Region != nil {
+			op.Region = Rect(*exportedOp.Region)
+		}
+		if op.OpType == "Add" && !op.Pruned {
+			op.Lines, _, err = blockartlib.ParseShape(op.ShapeSvgString, op.Fill, op.Stroke, settings.CanvasSettings)
+			if err != nil {
+				return Block{}, err
+			}
+			op.PathShape = blockartlib.ConstructSvgString(op.ShapeType, op.ShapeSvgString, op.Fill, op.Stroke)
+		}
+
+		block.SetOPs = append(block.SetOPs, op)
+	}
+
+	return block, nil
+}
+
+// HELPER FUNCTIONS
+
+// Initializes the heartbeat sends message to the server (message is the public key of miner so the server will remember it).
+func InitHeartbeat(cli *rpc.Client, pubKey ecdsa.PublicKey, heartBeat uint32) {
+	for {
+		var reply bool
+		err := cli.Call("RServer.HeartBeat", pubKey, &reply)
+		HandleError(err)
+
+		time.Sleep(time.Duration(int(heartBeat)/5) * time.Millisecond)
+	}
+}
+
+// Serves every incoming connection with its own RPC server, so that each connection gets its own
+// ArtKey and an art node's validated key cannot be used from any other connection.
+func AcceptConnections(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			HandleError(err)
+			continue
+		}
+
+		go ServeConnection(conn)
+	}
+}
+
+// Serves the RPCs of a single connection and closes its art node session once it disconnects.
+func ServeConnection(conn net.Conn) {
+	artKey := &ArtKey{}
+
+	server := rpc.NewServer()
+	server.Register(new(MinerKey))
+	server.Register(artKey)
+
+	server.ServeConn(conn)
+	artKey.CloseSession()
+}
+
+// Opens a session for a validated art node, unless MaxArtNodeSessions are already open.
+func OpenSession(artNodeID int, key ecdsa.PublicKey) (*ArtNodeSession, error) {
+	artNodeSessions.Lock()
+	defer artNodeSessions.Unlock()
+
+	if len(artNodeSessions.all) >= MaxArtNodeSessions {
+		return nil, blockartlib.SessionLimitError(fmt.Sprintf("%d art nodes already connected", MaxArtNodeSessions))
+	}
+
+	artNodeSessions.nextID++
+	session := &ArtNodeSession{
+		ID:          artNodeSessions.nextID,
+		ArtNodeID:   artNodeID,
+		PubKey:      key,
+		ConnectedAt: time.Now(),
+		PendingOps:  []string{},
+	}
+	artNodeSessions.all[session.ID] = session
+
+	return session, nil
+}
+
+func CloseSession(id int) {
+	artNodeSessions.Lock()
+	defer artNodeSessions.Unlock()
+
+	delete(artNodeSessions.all, id)
+}
+
+// Records an operation waiting for validation, unless the session already has MaxPendingOpsPerSession.
+func AddPendingOp(session *ArtNodeSession, uniqueID string) error {
+	artNodeSessions.Lock()
+	defer artNodeSessions.Unlock()
+
+	if len(session.PendingOps) >= MaxPendingOpsPerSession {
+		return blockartlib.SessionLimitError(fmt.Sprintf("%d operations already pending", MaxPendingOpsPerSession))
+	}
+
+	session.PendingOps = append(session.PendingOps, uniqueID)
+	return nil
+}
+
+func RemovePendingOp(session *ArtNodeSession, uniqueID string) {
+	artNodeSessions.Lock()
+	defer artNodeSessions.Unlock()
+
+	for i, id := range session.PendingOps {
+		if id == uniqueID {
+			session.PendingOps = append(session.PendingOps[:i], session.PendingOps[i+1:]...)
+			break
 		}
 	}
-
-	return CheckIntersection(operation)
 }
 
-// HELPER FUNCTIONS
+func AddInkSpent(session *ArtNodeSession, ink uint32) {
+	artNodeSessions.Lock()
+	defer artNodeSessions.Unlock()
 
-// Initializes the heartbeat sends message to the server (message is the public key of miner so the server will remember it).
-func InitHeartbeat(cli *rpc.Client, pubKey ecdsa.PublicKey, heartBeat uint32) {
-	for {
-		var reply bool
-		err := cli.Call("RServer.HeartBeat", pubKey, &reply)
-		HandleError(err)
+	session.InkSpent = session.InkSpent + ink
+}
 
-		time.Sleep(time.Duration(int(heartBeat)/5) * time.Millisecond)
+// Returns a snapshot of the session table, ordered by session ID.
+func SessionStatuses() []blockartlib.SessionStatus {
+	artNodeSessions.RLock()
+	defer artNodeSessions.RUnlock()
+
+	statuses := []blockartlib.SessionStatus{}
+	for _, session := range artNodeSessions.all {
+		pendingOps := make([]string, len(session.PendingOps))
+		copy(pendingOps, session.PendingOps)
+
+		statuses = append(statuses, blockartlib.SessionStatus{
+			ID:          session.ID,
+			ArtNodeID:   session.ArtNodeID,
+			PubKey:      session.PubKey,
+			ConnectedAt: session.ConnectedAt,
+			PendingOps:  pendingOps,
+			InkSpent:    session.InkSpent,
+		})
 	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+
+	return statuses
 }
 
 // Connect to the miners that the server has given.
@@ -772,18 +3277,18 @@ func ConnectToMiners(addrSet []net.Addr, currentAddress net.Addr, currentPubKey
 	for i := 0; i < len(addrSet); i++ {
 
 		addr := addrSet[i].String()
-		if _, ok := connectedMiners[addr]; !ok {
+		if _, ok := connectedMiners.Get(addr); !ok {
 
 			cli, err := rpc.Dial("tcp", addr)
 
 			if cli == nil {
-				delete(connectedMiners, addr)
+				connectedMiners.Remove(addr)
 			} else {
 				var reply MinerInfo
 				err = cli.Call("MinerKey.RegisterMiner", MinerInfo{Address: currentAddress, Key: currentPubKey}, &reply)
 				HandleError(err)
 
-				connectedMiners[reply.Address.String()] = Miner{Address: reply.Address, Key: reply.Key, Cli: cli}
+				connectedMiners.Add(Miner{Address: reply.Address, Key: reply.Key, Cli: cli})
 			}
 		}
 	}
@@ -793,7 +3298,7 @@ func ConnectToMiners(addrSet []net.Addr, currentAddress net.Addr, currentPubKey
 func GetNodes(cli *rpc.Client, minNumberConnections int) {
 	for {
 
-		if len(connectedMiners) < minNumberConnections {
+		if connectedMiners.Len() < minNumberConnections {
 
 			var addrSet []net.Addr
 
@@ -807,42 +3312,272 @@ func GetNodes(cli *rpc.Client, minNumberConnections int) {
 	}
 }
 
-// Returns the MD5 hash as a hex string for the OP Block (prev-hash + op + op-signature + pub-key + nonce) or No-OP Block (prev-hash + pub-key + nonce).
-// Nonce is the secret for this assignment, keep increasing Nonce to find a hash with correct trailing number of zeroes.
+// Builds the genesis block described by the settings and sets genesisAllocations. Fails if the
+// genesis hash of the settings is not the hash of the genesis contents.
+func NewGenesisBlock(settings blockartlib.MinerNetSettings) (*Block, error) {
+	hash, err := blockartlib.GenesisHash(settings.Genesis)
+	if err != nil {
+		return nil, err
+	}
+	if hash != settings.GenesisBlockHash {
+		return nil, errors.New("Genesis block hash " + settings.GenesisBlockHash + " does not match the genesis settings (" + hash + ")")
+	}
+
+	allocations := make(map[string]uint32)
+	for _, allocation := range settings.Genesis.Allocations {
+		key, err := blockartlib.ParsePublicKey(allocation.PubKey)
+		if err != nil {
+			return nil, errors.New("Bad key in genesis allocation: " + err.Error())
+		}
+
+		allocations[PubKeyToString(key)] += allocation.Ink
+	}
+
+	shapes := []Operation{}
+	for _, shape := range settings.Genesis.Shapes {
+		key, err := blockartlib.ParsePublicKey(shape.PubKey)
+		if err != nil {
+			return nil, errors.New("Bad key in genesis shape: " + err.Error())
+		}
+
+		lines, _, err := blockartlib.ParseShape(shape.SvgString, shape.Fill, shape.Stroke, settings.CanvasSettings)
+		if err != nil {
+			return nil, errors.New("Bad genesis shape: " + err.Error())
+		}
+
+		shapes = append(shapes, Operation{
+			ShapeType:      blockartlib.PATH,
+			ArtNodePubKey:  key,
+			OpType:         "Add",
+			ShapeSvgString: shape.SvgString,
+			Fill:           shape.Fill,
+			Stroke:         shape.Stroke,
+			Lines:          lines,
+			PathShape:      blockartlib.ConstructSvgString(blockartlib.PATH, shape.SvgString, shape.Fill, shape.Stroke),
+		})
+	}
+
+	for i := range shapes {
+		shapes[i].UniqueID = hash + "-" + strconv.Itoa(i)
+	}
+
+	genesisAllocations = allocations
+	return &Block{Hash: hash, Version: blockartlib.BlockVersion, SetOPs: shapes, PathLength: 1, Target: blockartlib.DifficultyTarget(settings.PoWDifficultyNoOpBlock)}, nil
+}
+
+// Returns the hash of the block header (see blockartlib.BlockHeader). Miners keep changing
+// Nonce and ExtraNonce until the hash meets the target of the block.
 func ComputeBlockHash(block Block) string {
-	h := md5.New()
-	hash := block.PreviousHash
-	// this states if it is an op block (has set of OPs) or not
-	if len(block.SetOPs) > 0 {
-		for i := 0; i < len(block.SetOPs); i++ {
-			hash = hash + string(block.SetOPs[i].ShapeType) + block.SetOPs[i].UniqueID
+	return HeaderOf(block).Hash()
+}
+
+// Returns the fields of the block that its hash covers.
+func HeaderOf(block Block) blockartlib.BlockHeader {
+	return blockartlib.BlockHeader{
+		Version:      block.Version,
+		PreviousHash: block.PreviousHash,
+		MerkleRoot:   block.MerkleRoot,
+		MinerPubKey:  block.MinerPubKey,
+		Nonce:        block.Nonce,
+		ExtraNonce:   block.ExtraNonce,
+		Timestamp:    block.Timestamp,
+		Target:       block.Target,
+	}
+}
+
+// Goroutine that catches up with the longest chain of every connected miner.
+func SyncWithMiners() {
+	for {
+		for key, miner := range connectedMiners.All() {
+			err := SyncWithMiner(miner)
+			if err != nil {
+				if err.Error() == "connection is shut down" {
+					connectedMiners.Remove(key)
+				} else {
+					fmt.Println("Sync with " + key + " failed: " + err.Error())
+				}
+			}
 		}
+
+		time.Sleep(7 * time.Second)
 	}
-	minerPubKey, _ := json.Marshal(block.MinerPubKey)
-	h.Write([]byte(hash + string(minerPubKey) + strconv.Itoa(int(block.Nonce))))
-	str := hex.EncodeToString(h.Sum(nil))
-	return str
 }
 
-// Updates everyone's blockchain to only include the LONGEST blockchain
-func SyncMinersLongestChain() {
+// Fetches the headers of the miner's longest chain after the last block we have in common with it,
+// then the bodies of the blocks we do not have. Every block is validated before it is stored. All
+// headers are fetched and checked first, so the height the miner may have pruned to is derived
+// from work this miner checked itself rather than the height the miner claims (see
+// PrunedHeightAt).
+func SyncWithMiner(miner Miner) error {
+	headers := []BlockHeader{}
+	locator := BlockLocator()
 	for {
+		var batch []BlockHeader
+		err := miner.Cli.Call("MinerKey.GetHeaders", locator, &batch)
+		if err != nil {
+			return err
+		}
+
+		headers = append(headers, batch...)
+		if len(batch) < MaxHeadersPerRequest {
+			break
+		}
+		locator = []string{batch[len(batch)-1].Hash}
+	}
+
+	if len(headers) == 0 {
+		return nil
+	}
+	height, err := CheckHeaders(headers)
+	if err != nil {
+		return err
+	}
+	prunedHeight := PrunedHeightAt(height)
 
-		if len(connectedMiners) > 0 {
+	missing := []string{}
+	for _, header := range headers {
+		if !ExistInLocalBlockchain(header.Hash) {
+			missing = append(missing, header.Hash)
+		}
+	}
+
+	for start := 0; start < len(missing); start += MaxBlocksPerRequest {
+		batch := missing[start:]
+		if len(batch) > MaxBlocksPerRequest {
+			batch = batch[:MaxBlocksPerRequest]
+		}
 
-			longestBlockChain := globalChain
-			blockList = longestBlockChain
-			var reply string
+		var blocks []Block
+		err := miner.Cli.Call("MinerKey.GetBlocks", batch, &blocks)
+		if err != nil {
+			return err
+		}
 
-			for _, miner := range connectedMiners {
-				miner.Cli.Call("MinerKey.UpdateLongestBlockChain", LongestBlockChain{BlockChain: longestBlockChain}, &reply)
+		for i, block := range blocks {
+			if block.Hash != batch[i] {
+				return errors.New("Received block " + block.Hash + " instead of " + batch[i])
+			}
+			if ExistInLocalBlockchain(block.Hash) {
+				continue
+			}
+			if err := AcceptPrunedBlock(block, prunedHeight); err != nil {
+				return err
 			}
 		}
+	}
 
-		time.Sleep(7 * time.Second)
+	return nil
+}
+
+// Returns up to MaxHeadersPerRequest blocks of the longest chain following the first locator hash
+// that is on it, oldest first, or following the genesis block if none of them are on it.
+func BlocksAfterLocator(locator []string) []Block {
+	chainLock.RLock()
+	defer chainLock.RUnlock()
+
+	start := 1
+	for _, hash := range locator {
+		block, exists := blockStore.Get(hash)
+		if exists && block.PathLength <= len(globalChain) && globalChain[block.PathLength-1].Hash == hash {
+			start = block.PathLength
+			break
+		}
+	}
+
+	blocks := []Block{}
+	for i := start; i < len(globalChain) && len(blocks) < MaxHeadersPerRequest; i++ {
+		blocks = append(blocks, globalChain[i])
+	}
+
+	return blocks
+}
+
+// Checks that the headers form a chain from a stored block, each at the height after its parent,
+// with a hash that matches the header and meets the target its parent calls for, and returns the
+// height of the last one. The height is only as trustworthy as the work of the headers, which is
+// why pruned operations are only taken from blocks this far below it (see PrunedHeightAt).
+func CheckHeaders(headers []BlockHeader) (int, error) {
+	parent, exists := blockStore.Get(headers[0].PreviousHash)
+	if !exists {
+		return 0, errors.New("Headers do not start from a known block")
+	}
+
+	for _, header := range headers {
+		if header.PreviousHash != parent.Hash {
+			return 0, errors.New("Headers do not form a chain")
+		}
+		if header.PathLength != parent.PathLength+1 {
+			return 0, errors.New("Header " + header.Hash + " is not at the height after its parent")
+		}
+
+		block := HeaderBlock(header.BlockHeader, header.Hash, parent)
+		if err := CheckHeaderWork(block); err != nil {
+			return 0, err
+		}
+		parent = block
+	}
+
+	return parent.PathLength, nil
+}
+
+// Returns the header as a block without operations on top of parent, so that it can be checked
+// before the block itself is fetched (see CheckHeaderWork).
+func HeaderBlock(header blockartlib.BlockHeader, hash string, parent *Block) *Block {
+	return &Block{
+		PreviousBlock: parent,
+		PreviousHash:  header.PreviousHash,
+		Hash:          hash,
+		Version:       header.Version,
+		MerkleRoot:    header.MerkleRoot,
+		MinerPubKey:   header.MinerPubKey,
+		Nonce:         header.Nonce,
+		ExtraNonce:    header.ExtraNonce,
+		Timestamp:     header.Timestamp,
+		Target:        header.Target,
+		PathLength:    parent.PathLength + 1,
 	}
 }
 
+// Checks that the block has a known version, a hash that matches its header and meets the target
+// its parent calls for, without its operations: whether it is an Op block is read from its
+// Merkle root.
+func CheckHeaderWork(block *Block) error {
+	if block.Version != blockartlib.BlockVersion {
+		return errors.New("Unknown block version " + strconv.Itoa(int(block.Version)))
+	}
+	if ComputeBlockHash(*block) != block.Hash {
+		return errors.New("Header hash does not match its contents")
+	}
+	if err := CheckProofOfWork(*block, !bytes.Equal(block.MerkleRoot, blockartlib.MerkleRoot(nil))); err != nil {
+		return err
+	}
+	return CheckBlockTarget(*block, block.PreviousBlock)
+}
+
+// Returns hashes of blocks on our longest chain, newest first: the last ten blocks, then blocks
+// further and further apart, always ending with the genesis block.
+func BlockLocator() []string {
+	locator := []string{}
+
+	block, exists := blockStore.Get(chainState.TipHash())
+	if !exists {
+		return []string{blockStore.Genesis().Hash}
+	}
+
+	step := 1
+	for block.PreviousBlock != nil {
+		locator = append(locator, block.Hash)
+		if len(locator) >= 10 {
+			step = step * 2
+		}
+		for i := 0; i < step && block.PreviousBlock != nil; i++ {
+			block = block.PreviousBlock
+		}
+	}
+
+	return append(locator, block.Hash)
+}
+
 // CALL THIS TO REVERSE AFTER FINDING LONGEST CHAIN USING END NODE
 // [E ... G] -> [G ... E] TO MATCH BLOCKLIST ORDERING
 func ReverseArray(reverseThis []Block) {
@@ -854,11 +3589,7 @@ func ReverseArray(reverseThis []Block) {
 // Checks whether or not operations are validated or not and returns block where op is in (check validateNum against the block)
 func CheckOperationValidation(uniqueID string) (Block, bool) {
 	timeOut := 0
-
-	// blockToCheck is the block that contains the checked Operation
-	blockToCheck := Block{}
 	opToCheck := Operation{}
-	foundBlock := false
 
 	for {
 		// Times out, sends reply back (2 min)
@@ -867,112 +3598,210 @@ func CheckOperationValidation(uniqueID string) (Block, bool) {
 			return Block{}, false
 		}
 
-		// Get the block that we need (where the operation is in)
-		if !foundBlock {
-			for i := 0; i < len(blockList); i++ {
-				opList := blockList[i].SetOPs
+		chainLock.RLock()
 
-				for j := 0; j < len(opList); j++ {
-
-					if opList[j].UniqueID == uniqueID {
-						foundBlock = true
-						blockToCheck = blockList[i]
-						opToCheck = opList[j]
-						break
-					}
+		// The operation counts once its block is ValidateNum blocks deep on the longest chain
+		if block, exists := blockStore.Get(chainState.OperationBlock(uniqueID)); exists {
+			for _, op := range block.SetOPs {
+				if op.UniqueID == uniqueID {
+					opToCheck = op
 				}
 			}
-		}
-
-		if foundBlock {
-			// Goes through each end blocks to find the one that consists blockToCheck
-			for k := len(blockList) - 1; k > 0; k-- {
 
-				if blockList[k].IsEndBlock == true {
-
-					blockChain := FindBlockChainPath(blockList[k])
-					for l := 0; l < len(blockChain); l++ {
-
-						if blockChain[l].Hash == blockToCheck.Hash {
-							if blockList[k].PathLength-blockChain[l].PathLength >= opToCheck.ValidateNum {
-								fmt.Printf("Operation is validated: %s - %s \n", opToCheck.OpType, opToCheck.ShapeSvgString)
-								return blockToCheck, true
-							}
-							break
-						}
-					}
-				}
+			tip := globalChain[len(globalChain)-1]
+			if tip.PathLength-block.PathLength >= opToCheck.ValidateNum {
+				chainLock.RUnlock()
+				fmt.Printf("Operation is validated: %s - %s \n", opToCheck.OpType, opToCheck.ShapeSvgString)
+				return *block, true
 			}
 		}
 
+		chainLock.RUnlock()
+
 		time.Sleep(300 * time.Millisecond)
 		timeOut = timeOut + 1
 	}
 }
 
 func FindOperationInLongestChain(shapeHash string) Operation {
-	longestBlockChain := globalChain
+	chainLock.RLock()
+	defer chainLock.RUnlock()
 
-	for _, block := range longestBlockChain {
-		for _, op := range block.SetOPs {
-			if op.UniqueID == shapeHash {
-				return op
-			}
+	block, exists := blockStore.Get(chainState.OperationBlock(shapeHash))
+	if !exists {
+		return Operation{}
+	}
+
+	for _, op := range block.SetOPs {
+		if op.UniqueID == shapeHash {
+			return op
 		}
 	}
 
 	return Operation{}
 }
 
-func (artkey *ArtKey) GetChildren(blockHash string, children *[]string) error {
-	hashExists := false
-	result := []string{}
+// Returns every operation in the local block tree that created or targeted the shape, with the
+// block it is in and whether that block is on the longest chain. Ordered by block height.
+func (artkey *ArtKey) GetShapeHistory(shapeHash string, history *[]blockartlib.ShapeEvent) error {
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
 
-	for _, block := range blockList {
+	chainLock.RLock()
+	defer chainLock.RUnlock()
 
-		if block.Hash == blockHash {
-			hashExists = true
-		}
-		if block.PreviousHash == blockHash {
-			result = append(result, block.Hash)
+	onLongestChain := make(map[string]bool)
+	for _, block := range globalChain {
+		onLongestChain[block.Hash] = true
+	}
+
+	events := []blockartlib.ShapeEvent{}
+	for _, block := range blockStore.All() {
+		for _, op := range block.SetOPs {
+			if op.UniqueID != shapeHash && op.DeleteUniqueID != shapeHash {
+				continue
+			}
+
+			events = append(events, blockartlib.ShapeEvent{
+				OpType:         op.OpType,
+				OpHash:         op.UniqueID,
+				ArtNodePubKey:  op.ArtNodePubKey,
+				BlockHash:      block.Hash,
+				BlockHeight:    block.PathLength,
+				OnLongestChain: onLongestChain[block.Hash],
+			})
 		}
 	}
 
-	if !hashExists {
+	if len(events) == 0 {
+		return errors.New("Does not exist")
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].BlockHeight < events[j].BlockHeight })
+
+	*history = events
+	return nil
+}
+
+// Returns the headers of the longest chain following the first locator hash that is on it, for
+// art nodes that verify the chain themselves (see blockartlib.OpenVerifyingCanvas).
+func (artkey *ArtKey) GetHeaders(locator []string, headers *[]blockartlib.BlockHeader) error {
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	*headers = []blockartlib.BlockHeader{}
+	for _, block := range BlocksAfterLocator(locator) {
+		*headers = append(*headers, HeaderOf(block))
+	}
+
+	return nil
+}
+
+// Returns the header of a stored block other than the genesis block, which has no header.
+func (artkey *ArtKey) GetHeader(blockHash string, header *blockartlib.BlockHeader) error {
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	chainLock.RLock()
+	defer chainLock.RUnlock()
+
+	block, exists := blockStore.Get(blockHash)
+	if !exists || block.PreviousBlock == nil {
+		return errors.New("Hash does not exist")
+	}
+
+	*header = HeaderOf(*block)
+	return nil
+}
+
+// Returns the operations of a stored block, which the Merkle root of its header commits to. Pruned
+// operations are returned with their leaves only.
+func (artkey *ArtKey) GetBlockOperations(blockHash string, operations *[]Operation) error {
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	chainLock.RLock()
+	defer chainLock.RUnlock()
+
+	block, exists := blockStore.Get(blockHash)
+	if !exists {
+		return errors.New("Hash does not exist")
+	}
+
+	// pruned operations carry their leaves, so the root can still be checked
+	*operations = block.SetOPs
+	return nil
+}
+
+// Returns the events of the operations confirmed to the art node's key that come after the event
+// numbered since (see OperationWatch).
+func (artkey *ArtKey) GetOperationEvents(since uint64, events *[]blockartlib.OperationEvent) error {
+	session, err := artkey.AuthorizedSession()
+	if err != nil {
+		return err
+	}
+
+	*events = operationWatch.Events(PubKeyToString(session.PubKey), since)
+	return nil
+}
+
+func (artkey *ArtKey) GetChildren(blockHash string, children *[]string) error {
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	if _, exists := blockStore.Get(blockHash); !exists {
 		return errors.New("Hash does not exist")
 	}
 
-	*children = result
+	*children = blockStore.Children(blockHash)
 	return nil
 }
 
 func (artkey *ArtKey) GetGenesisBlock(doNotUse string, genesisHash *string) error {
-	*genesisHash = blockList[0].Hash
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	*genesisHash = blockStore.Genesis().Hash
 	return nil
 }
 
 func (artkey *ArtKey) GetShapes(blockHash string, shapeHashes *[]string) error {
-	result := []string{}
-	for _, block := range blockList {
-		if block.Hash == blockHash {
-			operations := block.SetOPs
+	if err := artkey.CheckAuthorized(); err != nil {
+		return err
+	}
 
-			for _, op := range operations {
-				result = append(result, op.UniqueID)
-			}
+	chainLock.RLock()
+	defer chainLock.RUnlock()
 
-			*shapeHashes = result
-			return nil
-		}
+	block, exists := blockStore.Get(blockHash)
+	if !exists {
+		return errors.New("Invalid shape hash")
+	}
+
+	result := []string{}
+	for _, op := range block.SetOPs {
+		result = append(result, op.UniqueID)
 	}
 
-	return errors.New("Invalid shape hash")
+	*shapeHashes = result
+	return nil
 }
 
 func (artKey *ArtKey) GetOperationWithShapeHash(shapeHash string, operation *Operation) error {
+	if err := artKey.CheckAuthorized(); err != nil {
+		return err
+	}
+
 	op := FindOperationInLongestChain(shapeHash)
 
-	if op.UniqueID == "" {
+	// the body of a pruned operation is gone, it is no longer on the canvas
+	if op.UniqueID == "" || op.Pruned {
 		return errors.New("Does not exist")
 	}
 
@@ -980,62 +3809,95 @@ func (artKey *ArtKey) GetOperationWithShapeHash(shapeHash string, operation *Ope
 	return nil
 }
 
+// Returns the operation with the shape hash on the longest chain, with the header of its block
+// and the Merkle branch that shows the operation is in the block.
+func (artKey *ArtKey) GetOperationProof(shapeHash string, proof *blockartlib.OperationProof) error {
+	if err := artKey.CheckAuthorized(); err != nil {
+		return err
+	}
+
+	chainLock.RLock()
+	defer chainLock.RUnlock()
+
+	// the shapes of the genesis block are part of the settings, not of a header
+	block, exists := blockStore.Get(chainState.OperationBlock(shapeHash))
+	if !exists || block.PreviousBlock == nil {
+		return errors.New("Does not exist")
+	}
+
+	for i, op := range block.SetOPs {
+		if op.UniqueID != shapeHash {
+			continue
+		}
+
+		// the operation itself has to be there to be checked against its leaf; the branch is built
+		// from the leaves of the other operations, pruned or not
+		if op.Pruned {
+			return errors.New("Does not exist")
+		}
+
+		*proof = blockartlib.OperationProof{Operation: op, Header: HeaderOf(*block), Branch: blockartlib.MerkleBranch(block.SetOPs, i)}
+		return nil
+	}
+
+	return errors.New("Does not exist")
+}
+
 func (artKey *ArtKey) DeleteShape(shapeHash string, inkRemaining *uint32) error {
+	session, err := artKey.AuthorizedSession()
+	if err != nil {
+		return err
+	}
+
 	op := FindOperationInLongestChain(shapeHash)
 
 	if op.UniqueID == "" {
 		return errors.New("Does not exist")
 	}
-	if !reflect.DeepEqual(pubKey, op.ArtNodePubKey) {
+	if !reflect.DeepEqual(session.PubKey, op.ArtNodePubKey) {
 		return errors.New("Did not create")
 	}
 
-	longestBlockChain := globalChain
-	for i := len(longestBlockChain) - 1; i >= 0; i-- {
-		block := longestBlockChain[i]
-		if reflect.DeepEqual(block.MinerPubKey, pubKey) {
-			*inkRemaining = block.TotalInkAmount + op.OpInkCost
-			break
-		}
-	}
+	*inkRemaining = chainState.Balance(session.PubKey) + op.OpInkCost
 
 	return nil
 }
 
 func (artkey *ArtKey) ValidateDelete(operation Operation, reply *bool) error {
-	longestBlockChain := globalChain
-
-	err := ValidateOperationForLongestChain(operation, longestBlockChain)
+	session, err := artkey.CheckOperationKey(operation)
 	if err != nil {
 		return err
 	}
 
-	operationsHistory = append(operationsHistory, operation.UniqueID)
-	operations = append(operations, operation)
+	if err := ValidateOperation(operation, chainState); err != nil {
+		return err
+	}
+
+	if err := AddPendingOp(session, operation.UniqueID); err != nil {
+		return err
+	}
+	defer RemovePendingOp(session, operation.UniqueID)
+
+	mempool.Add(operation)
 
 	// Floods the network of miners with Operations
 
-	for key, miner := range connectedMiners {
+	for key, miner := range connectedMiners.All() {
 
 		err := miner.Cli.Call("MinerKey.ReceiveOperation", operation, &reply)
 
 		if err != nil {
 			if err.Error() == "connection is shut down" {
-				delete(connectedMiners, key)
+				connectedMiners.Remove(key)
 			}
 		}
 	}
 
 	_, valid := CheckOperationValidation(operation.UniqueID)
-	*reply = valid
-
-	for i := len(longestBlockChain) - 1; i >= 0; i-- {
-		block := longestBlockChain[i]
-		if reflect.DeepEqual(block.MinerPubKey, pubKey) {
-			block.TotalInkAmount = operation.OpInkCost
-			break
-		}
+	if valid {
+		operationWatch.Watch(operation)
 	}
+	*reply = valid
 
 	return nil
 }
@@ -1044,6 +3906,20 @@ func main() {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
 
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		var err error
+		if os.Args[1] == "export" {
+			err = ExportChain(os.Args[2:])
+		} else {
+			err = ImportChain(os.Args[2:])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	serverAddr := os.Args[1]
 
 	privateKeyBytesRestored, _ := hex.DecodeString(os.Args[3])
@@ -1057,23 +3933,46 @@ func main() {
 
 	cli, _ := rpc.Dial("tcp", serverAddr)
 
-	minerKey := new(MinerKey)
-	rpc.Register(minerKey)
-
-	artKey := new(ArtKey)
-	rpc.Register(artKey)
-
 	tcpAddr, _ = net.ResolveTCPAddr("tcp", os.Args[5])
 
 	err = cli.Call("RServer.Register", MinerInfo{Address: tcpAddr, Key: pubKey}, &settings)
 	HandleError(err)
 
-	blockList = append(blockList, Block{Hash: settings.GenesisBlockHash, PathLength: 1, IsEndBlock: true})
-	globalChain = FindLongestBlockChain()
+	genesis, err := NewGenesisBlock(settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	blockStore.Add(genesis)
+
+	_, listenPort, _ := net.SplitHostPort(os.Args[4])
+	dataDir := "inkminer-data-" + listenPort
+	if len(os.Args) > 6 {
+		dataDir = os.Args[6]
+	}
+	if len(os.Args) > 7 {
+		miningWorkers, err = strconv.Atoi(os.Args[7])
+		if err != nil || miningWorkers < 1 {
+			fmt.Fprintln(os.Stderr, "Bad number of mining workers: "+os.Args[7])
+			os.Exit(1)
+		}
+	}
+
+	file, storedBlocks, offsets, err := OpenChainFile(dataDir)
+	if err != nil {
+		fmt.Println("Could not open chain file, blocks will not be stored: " + err.Error())
+	} else {
+		replayed, err := ReplayChainFile(file, storedBlocks, offsets)
+		HandleError(err)
+		fmt.Printf("Replayed %d blocks from %s\n", replayed, dataDir)
+		chainFile = file
+	}
+
+	SetLongestChain(FindLongestChainTip())
 
 	go InitHeartbeat(cli, pubKey, settings.HeartBeat)
 
-	go rpc.Accept(lis)
+	go AcceptConnections(lis)
 
 	var addrSet []net.Addr
 	err = cli.Call("RServer.GetNodes", pubKey, &addrSet)
@@ -1083,19 +3982,26 @@ func main() {
 
 	go GetNodes(cli, int(settings.MinNumMinerConnections))
 
-	go SyncMinersLongestChain()
+	go SyncWithMiners()
 
 	go printForDemo()
 
+	go ReportHashRate()
+
 	GenerateBlock()
 }
 
 // FOR TESTING
 func printForDemo() {
 	for {
-		fmt.Println("Length of the Current Global Chain: " + strconv.Itoa(len(globalChain)))
-		fmt.Println("Connected Miners (" + strconv.Itoa(len(connectedMiners)) + ") : ")
-		for key, _ := range connectedMiners {
+		chainLock.RLock()
+		chainLength := len(globalChain)
+		chainLock.RUnlock()
+
+		miners := connectedMiners.All()
+		fmt.Println("Length of the Current Global Chain: " + strconv.Itoa(chainLength))
+		fmt.Println("Connected Miners (" + strconv.Itoa(len(miners)) + ") : ")
+		for key, _ := range miners {
 			fmt.Println(key)
 		}
 		time.Sleep(30 * time.Second)
@@ -0,0 +1,2125 @@
+package main
+
+// The tests share the miner's package state, so every test resets the parts it uses (most of
+// them with newTestChain) and none of them run in parallel.
+// Run with: go test -race ink-miner.go ink-miner_test.go
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"./blockartlib"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Runs the GetNonce and ValidateKey handshake of an art node on the connection.
+func validateTestKey(t *testing.T, artKey *ArtKey, artNodeID int, key *ecdsa.PrivateKey) error {
+	var nonce []byte
+	if err := artKey.GetNonce("", &nonce); err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var canvasSettings blockartlib.CanvasSettings
+	return artKey.ValidateKey(blockartlib.ArtNodeKey{ArtNodeID: artNodeID, PubKey: key.PublicKey, R: r, S: s, Hash: nonce}, &canvasSettings)
+}
+
+func TestValidateKeyBindsConnection(t *testing.T) {
+	artist := newTestKey(t)
+	other := newTestKey(t)
+
+	connection := &ArtKey{}
+	if err := connection.CheckAuthorized(); err == nil {
+		t.Error("connection is authorized before ValidateKey")
+	}
+	if err := validateTestKey(t, connection, 1, artist); err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.CheckAuthorized(); err != nil {
+		t.Error(err)
+	}
+
+	// operations have to be issued by the key of the connection
+	op := Operation{ArtNodeID: 1, ArtNodePubKey: artist.PublicKey}
+	if _, err := connection.CheckOperationKey(op); err != nil {
+		t.Error(err)
+	}
+	op.ArtNodePubKey = other.PublicKey
+	if _, err := connection.CheckOperationKey(op); err == nil {
+		t.Error("operation of another key is accepted")
+	}
+	var reply Block
+	if err := connection.AddShape(op, &reply); err == nil {
+		t.Error("AddShape accepts an operation of another key")
+	}
+
+	// another connection is not bound to the key
+	if _, err := (&ArtKey{}).CheckOperationKey(Operation{ArtNodeID: 1, ArtNodePubKey: artist.PublicKey}); err == nil {
+		t.Error("operation is accepted on a connection that did not validate")
+	}
+}
+
+func TestValidateKeyRejectsBadSignatures(t *testing.T) {
+	artist := newTestKey(t)
+	other := newTestKey(t)
+	var canvasSettings blockartlib.CanvasSettings
+
+	// the nonce has to come from this connection
+	connection := &ArtKey{}
+	nonce := []byte("a nonce the miner never issued")
+	r, s, err := ecdsa.Sign(rand.Reader, artist, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := blockartlib.ArtNodeKey{ArtNodeID: 1, PubKey: artist.PublicKey, R: r, S: s, Hash: nonce}
+	if err := connection.ValidateKey(key, &canvasSettings); err == nil {
+		t.Error("signature over a nonce that was not issued is accepted")
+	}
+
+	// signed by another key
+	if err := connection.GetNonce("", &nonce); err != nil {
+		t.Fatal(err)
+	}
+	if key.R, key.S, err = ecdsa.Sign(rand.Reader, other, nonce); err != nil {
+		t.Fatal(err)
+	}
+	key.Hash = nonce
+	err = connection.ValidateKey(key, &canvasSettings)
+	if _, ok := err.(blockartlib.InvalidKeyError); !ok {
+		t.Errorf("signature of another key returns %v, expected an InvalidKeyError", err)
+	}
+
+	// a nonce is good for one attempt only
+	if err := connection.GetNonce("", &nonce); err != nil {
+		t.Fatal(err)
+	}
+	if key.R, key.S, err = ecdsa.Sign(rand.Reader, artist, nonce); err != nil {
+		t.Fatal(err)
+	}
+	key.Hash = nonce
+	if err := connection.ValidateKey(key, &canvasSettings); err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.ValidateKey(key, &canvasSettings); err == nil {
+		t.Error("nonce is accepted twice")
+	}
+}
+
+func TestValidateKeyRequiresP384Key(t *testing.T) {
+	artist := newTestKey(t)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artNodeSessions = ArtNodeSessions{all: make(map[int]*ArtNodeSession)}
+
+	// signs a nonce of a new connection with signer, and presents pubKey
+	validate := func(signer *ecdsa.PrivateKey, pubKey ecdsa.PublicKey) error {
+		connection := &ArtKey{}
+		var nonce []byte
+		if err := connection.GetNonce("", &nonce); err != nil {
+			t.Fatal(err)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, signer, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var canvasSettings blockartlib.CanvasSettings
+		key := blockartlib.ArtNodeKey{ArtNodeID: 1, PubKey: pubKey, R: r, S: s, Hash: nonce}
+		defer connection.CloseSession()
+		return connection.ValidateKey(key, &canvasSettings)
+	}
+
+	// keys decoded from gob carry the curve as bare CurveParams
+	decoded := artist.PublicKey
+	params := *elliptic.P384().Params()
+	decoded.Curve = &params
+	if err := validate(artist, decoded); err != nil {
+		t.Errorf("P-384 key with the curve as CurveParams is rejected: %v", err)
+	}
+
+	noCurve := artist.PublicKey
+	noCurve.Curve = nil
+	emptyCurve := artist.PublicKey
+	emptyCurve.Curve = &elliptic.CurveParams{}
+	noPoint := artist.PublicKey
+	noPoint.Y = nil
+	for name, pubKey := range map[string]ecdsa.PublicKey{
+		"no curve":    noCurve,
+		"empty curve": emptyCurve,
+		"no point":    noPoint,
+		"P-256":       p256.PublicKey,
+	} {
+		signer := artist
+		if name == "P-256" {
+			signer = p256
+		}
+		if _, ok := validate(signer, pubKey).(blockartlib.InvalidKeyError); !ok {
+			t.Errorf("%s: key is not rejected with an InvalidKeyError", name)
+		}
+	}
+}
+
+func TestSessionsPerConnection(t *testing.T) {
+	artNodeSessions = ArtNodeSessions{all: make(map[int]*ArtNodeSession)}
+	first, second := newTestKey(t), newTestKey(t)
+
+	firstConnection, secondConnection := &ArtKey{}, &ArtKey{}
+	if err := validateTestKey(t, firstConnection, 1, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateTestKey(t, secondConnection, 2, second); err != nil {
+		t.Fatal(err)
+	}
+
+	var sessions []blockartlib.SessionStatus
+	if err := firstConnection.GetSessions("", &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ArtNodeID != 1 || sessions[1].ArtNodeID != 2 {
+		t.Fatalf("sessions are %+v, expected art nodes 1 and 2", sessions)
+	}
+	if sessions[1].PubKey.X.Cmp(second.PublicKey.X) != 0 {
+		t.Error("session of the second connection does not hold its key")
+	}
+
+	// validating again replaces the session of the connection
+	if err := validateTestKey(t, firstConnection, 1, first); err != nil {
+		t.Fatal(err)
+	}
+	if sessions := SessionStatuses(); len(sessions) != 2 {
+		t.Errorf("%d sessions after validating again, expected 2", len(sessions))
+	}
+
+	var ink uint32
+	if err := firstConnection.CloseCanvas("", &ink); err != nil {
+		t.Fatal(err)
+	}
+	if err := firstConnection.CheckAuthorized(); err == nil {
+		t.Error("connection is still authorized after CloseCanvas")
+	}
+	if sessions := SessionStatuses(); len(sessions) != 1 || sessions[0].ArtNodeID != 2 {
+		t.Errorf("sessions after CloseCanvas are %+v, expected art node 2", sessions)
+	}
+
+	// what ServeConnection does when the connection drops
+	secondConnection.CloseSession()
+	if sessions := SessionStatuses(); len(sessions) != 0 {
+		t.Errorf("%d sessions after disconnecting, expected none", len(sessions))
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	artNodeSessions = ArtNodeSessions{all: make(map[int]*ArtNodeSession)}
+	artist := newTestKey(t)
+
+	connections := []*ArtKey{}
+	for i := 0; i < MaxArtNodeSessions; i++ {
+		connection := &ArtKey{}
+		if err := validateTestKey(t, connection, i, artist); err != nil {
+			t.Fatal(err)
+		}
+		connections = append(connections, connection)
+	}
+	err := validateTestKey(t, &ArtKey{}, MaxArtNodeSessions, artist)
+	if _, ok := err.(blockartlib.SessionLimitError); !ok {
+		t.Errorf("session over the limit returns %v, expected a SessionLimitError", err)
+	}
+
+	connections[0].CloseSession()
+	if err := validateTestKey(t, &ArtKey{}, MaxArtNodeSessions, artist); err != nil {
+		t.Errorf("closed session is still counted: %v", err)
+	}
+
+	session := connections[1].Session
+	for i := 0; i < MaxPendingOpsPerSession; i++ {
+		if err := AddPendingOp(session, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = AddPendingOp(session, "one too many")
+	if _, ok := err.(blockartlib.SessionLimitError); !ok {
+		t.Errorf("operation over the limit returns %v, expected a SessionLimitError", err)
+	}
+	RemovePendingOp(session, "0")
+	if err := AddPendingOp(session, "one too many"); err != nil {
+		t.Errorf("validated operation is still pending: %v", err)
+	}
+}
+
+// Returns a reservation of the region by the key for the number of blocks.
+func newTestReservation(key *ecdsa.PrivateKey, uniqueID string, region Rect, blocks int) Operation {
+	return Operation{
+		ArtNodePubKey: key.PublicKey,
+		OpType:        "Reserve",
+		OpInkCost:     blockartlib.CalcReserveInk(blockartlib.Rect(region), uint32(blocks)),
+		UniqueID:      uniqueID,
+		Region:        region,
+		ReserveBlocks: blocks,
+	}
+}
+
+func TestReservationsBlockOtherKeys(t *testing.T) {
+	settings.CanvasSettings = blockartlib.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024}
+	owner, other := newTestKey(t), newTestKey(t)
+
+	// reserved at height 2 for the blocks at heights 3 and 4
+	reservation := newTestReservation(owner, "reservation", Rect{MinX: 100, MinY: 100, MaxX: 200, MaxY: 200}, 2)
+	chain := NewChainState()
+	chain.Height = 2
+	chain.Reservations[reservation.UniqueID] = Reservation{Op: reservation, Height: 2}
+
+	line := func(key *ecdsa.PrivateKey, start, end Point) Operation {
+		return Operation{ArtNodePubKey: key.PublicKey, OpType: "Add", Lines: []Line{{Start: start, End: end}}}
+	}
+	square := func(key *ecdsa.PrivateKey, min, max float64, fill string) Operation {
+		corners := []Point{{X: min, Y: min}, {X: max, Y: min}, {X: max, Y: max}, {X: min, Y: max}}
+		op := Operation{ArtNodePubKey: key.PublicKey, OpType: "Add", Fill: fill}
+		for i := range corners {
+			op.Lines = append(op.Lines, Line{Start: corners[i], End: corners[(i+1)%len(corners)]})
+		}
+		return op
+	}
+	for _, test := range []struct {
+		name     string
+		op       Operation
+		reserved bool
+	}{
+		{"inside", line(other, Point{X: 150, Y: 150}, Point{X: 160, Y: 150}), true},
+		{"across", line(other, Point{X: 50, Y: 150}, Point{X: 250, Y: 150}), true},
+		{"outside", line(other, Point{X: 50, Y: 50}, Point{X: 250, Y: 50}), false},
+		{"owner", line(owner, Point{X: 150, Y: 150}, Point{X: 160, Y: 150}), false},
+		{"filled around", square(other, 50, 250, "red"), true},
+		{"transparent around", square(other, 50, 250, "transparent"), false},
+		{"filled inside", square(other, 120, 180, "red"), true},
+		{"filled apart", square(other, 300, 400, "red"), false},
+	} {
+		err := CheckReservations(test.op, chain)
+		if _, reserved := err.(blockartlib.RegionReservedError); reserved != test.reserved {
+			t.Errorf("%s: CheckReservations returns %v", test.name, err)
+		}
+	}
+
+	overlapping := newTestReservation(other, "overlapping", Rect{MinX: 150, MinY: 150, MaxX: 300, MaxY: 300}, 1)
+	if _, ok := ValidateReservation(overlapping, chain).(blockartlib.RegionReservedError); !ok {
+		t.Error("reservation overlapping another key's reservation is valid")
+	}
+	if err := ValidateReservation(newTestReservation(owner, "extended", overlapping.Region, 1), chain); err != nil {
+		t.Errorf("owner can not extend its reservation: %v", err)
+	}
+	outside := newTestReservation(other, "outside", Rect{MinX: 1000, MinY: 0, MaxX: 1100, MaxY: 10}, 1)
+	if _, ok := ValidateReservation(outside, chain).(blockartlib.OutOfBoundsError); !ok {
+		t.Error("reservation outside the canvas is valid")
+	}
+	cheap := newTestReservation(other, "cheap", Rect{MinX: 300, MinY: 300, MaxX: 400, MaxY: 400}, 1)
+	cheap.OpInkCost--
+	if err := ValidateReservation(cheap, chain); err == nil {
+		t.Error("reservation that pays too little ink is valid")
+	}
+
+	// the block at height 4 is the last one covered
+	chain.Height = 3
+	if len(ActiveReservations(chain)) != 1 {
+		t.Error("reservation ended before its last block")
+	}
+	chain.Height = 4
+	if err := CheckReservations(line(other, Point{X: 150, Y: 150}, Point{X: 160, Y: 150}), chain); err != nil {
+		t.Errorf("reservation is still active after its last block: %v", err)
+	}
+}
+
+// Stores the blocks on the miner, with chain as its longest chain.
+func setTestBlocks(blocks []Block, chain []Block) {
+	blockStore = NewBlockStore()
+	for i := range blocks {
+		blockStore.Add(&blocks[i])
+	}
+	globalChain = chain
+}
+
+func TestShapeHistory(t *testing.T) {
+	artist := newTestKey(t)
+	add := Operation{ArtNodePubKey: artist.PublicKey, OpType: "Add", UniqueID: "shape"}
+	remove := Operation{ArtNodePubKey: artist.PublicKey, OpType: "Delete", UniqueID: "delete", DeleteUniqueID: "shape"}
+
+	// the shape is deleted on the longest chain and on a fork
+	genesis := Block{Hash: "genesis", PathLength: 1, Target: blockartlib.MaxTarget}
+	added := Block{Hash: "added", PathLength: 2, SetOPs: []Operation{add}, Target: blockartlib.MaxTarget}
+	deleted := Block{Hash: "deleted", PathLength: 3, SetOPs: []Operation{remove}, Target: blockartlib.MaxTarget}
+	fork := Block{Hash: "fork", PathLength: 4, SetOPs: []Operation{remove}, Target: blockartlib.MaxTarget}
+	setTestBlocks([]Block{genesis, fork, added, deleted}, []Block{genesis, added, deleted})
+
+	artKey := &ArtKey{Session: &ArtNodeSession{}}
+	var history []blockartlib.ShapeEvent
+	if err := artKey.GetShapeHistory("shape", &history); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []blockartlib.ShapeEvent{
+		{OpType: "Add", OpHash: "shape", BlockHash: "added", BlockHeight: 2, OnLongestChain: true},
+		{OpType: "Delete", OpHash: "delete", BlockHash: "deleted", BlockHeight: 3, OnLongestChain: true},
+		{OpType: "Delete", OpHash: "delete", BlockHash: "fork", BlockHeight: 4, OnLongestChain: false},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("history has %d events, expected %d", len(history), len(expected))
+	}
+	for i, event := range history {
+		event.ArtNodePubKey = ecdsa.PublicKey{}
+		if event != expected[i] {
+			t.Errorf("event %d is %+v, expected %+v", i, event, expected[i])
+		}
+	}
+
+	if err := artKey.GetShapeHistory("unknown", &history); err == nil {
+		t.Error("unknown shape has a history")
+	}
+}
+
+func TestBlockStoreIndexesChildrenAndTips(t *testing.T) {
+	store := NewBlockStore()
+	genesis := &Block{Hash: "genesis", PathLength: 1, Target: blockartlib.MaxTarget}
+	store.Add(genesis)
+
+	first := &Block{Hash: "first", PreviousHash: "genesis", PreviousBlock: genesis, PathLength: 2, Target: blockartlib.MaxTarget}
+	second := &Block{Hash: "second", PreviousHash: "genesis", PreviousBlock: genesis, PathLength: 2, Target: blockartlib.MaxTarget}
+	child := &Block{Hash: "child", PreviousHash: "first", PreviousBlock: first, PathLength: 3, Target: blockartlib.MaxTarget}
+	for _, block := range []*Block{first, second, child, first} {
+		store.Add(block)
+	}
+
+	if store.Len() != 4 || store.Genesis() != genesis {
+		t.Errorf("store holds %d blocks from %s, expected 4 from genesis", store.Len(), store.Genesis().Hash)
+	}
+	if children := store.Children("genesis"); len(children) != 2 || children[0] != "first" || children[1] != "second" {
+		t.Errorf("children of genesis are %v", children)
+	}
+	if block, exists := store.Get("child"); !exists || block != child {
+		t.Error("child is not stored")
+	}
+
+	tips := map[string]bool{}
+	for _, tip := range store.Tips() {
+		tips[tip.Hash] = true
+	}
+	if len(tips) != 2 || !tips["second"] || !tips["child"] {
+		t.Errorf("tips are %v, expected second and child", tips)
+	}
+
+	var order []string
+	for _, block := range store.All() {
+		order = append(order, block.Hash)
+	}
+	if fmt.Sprint(order) != "[genesis first second child]" {
+		t.Errorf("blocks are in order %v, expected the order they were added in", order)
+	}
+}
+
+// Returns the hashes of the blocks.
+func blockHashes(blocks []Block) []string {
+	hashes := []string{}
+	for _, block := range blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes
+}
+
+func TestChainFileRecoversFromTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	file, blocks, _, err := OpenChainFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("new chain file holds %d blocks", len(blocks))
+	}
+	for i, hash := range []string{"first", "second", "third"} {
+		if err := file.Append(Block{Hash: hash, PathLength: i + 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	// a crash in the middle of writing the third record
+	blocksPath := filepath.Join(dir, "blocks.dat")
+	info, err := os.Stat(blocksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(blocksPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	file, blocks, offsets, err := OpenChainFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes := fmt.Sprint(blockHashes(blocks)); hashes != "[first second]" {
+		t.Fatalf("replayed %s, expected the blocks before the truncated record", hashes)
+	}
+	if blocks[1].PathLength != 3 {
+		t.Errorf("second block has path length %d, expected 3", blocks[1].PathLength)
+	}
+
+	// the next block is appended after the last complete record
+	if err := file.Append(Block{Hash: "fourth", PathLength: 4}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	file, blocks, offsets, err = OpenChainFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if hashes := fmt.Sprint(blockHashes(blocks)); hashes != "[first second fourth]" {
+		t.Fatalf("replayed %s after appending to the recovered file", hashes)
+	}
+	checkTestIndex(t, dir, blocks, offsets)
+
+	// a record whose checksum does not match ends the chain, and a stale index is rebuilt
+	data, err := ioutil.ReadFile(blocksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offsets[1]+8] ^= 0xff
+	if err := ioutil.WriteFile(blocksPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "blocks.idx"), []byte("stale 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, blocks, offsets, err = OpenChainFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if hashes := fmt.Sprint(blockHashes(blocks)); hashes != "[first]" {
+		t.Fatalf("replayed %s, expected the blocks before the corrupt record", hashes)
+	}
+	checkTestIndex(t, dir, blocks, offsets)
+}
+
+// Checks that the index in dir lists exactly the blocks at the offsets.
+func checkTestIndex(t *testing.T, dir string, blocks []Block, offsets []int64) {
+	index, err := ioutil.ReadFile(filepath.Join(dir, "blocks.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ""
+	for i := range blocks {
+		expected += indexEntry(blocks[i].Hash, offsets[i]) + "\n"
+	}
+	if string(index) != expected {
+		t.Errorf("index is %q, expected %q", index, expected)
+	}
+}
+
+// Stores a block with the operations on top of parent, mined by the key now.
+func addTestBlock(parent *Block, hash string, miner *ecdsa.PrivateKey, ops ...Operation) *Block {
+	block := &Block{
+		Timestamp:     time.Now().UnixNano() / int64(time.Millisecond),
+		PreviousBlock: parent,
+		PreviousHash:  parent.Hash,
+		Hash:          hash,
+		SetOPs:        ops,
+		MinerPubKey:   miner.PublicKey,
+		PathLength:    parent.PathLength + 1,
+		Target:        parent.Target,
+	}
+	blockStore.Add(block)
+	return block
+}
+
+func TestInkLedgerChargesEveryKey(t *testing.T) {
+	settings.InkPerOpBlock = 10
+	settings.InkPerNoOpBlock = 5
+	blockStore = NewBlockStore()
+	chainState = NewChainState()
+	genesis := &Block{Hash: "genesis", PathLength: 1, Target: blockartlib.MaxTarget}
+	blockStore.Add(genesis)
+
+	artist, miner, other := newTestKey(t), newTestKey(t), newTestKey(t)
+	expires := testExpiry(time.Now())
+	shape := Operation{ArtNodePubKey: artist.PublicKey, OpType: "Add", UniqueID: "shape", OpInkCost: 8, Expires: expires}
+	remove := Operation{ArtNodePubKey: artist.PublicKey, OpType: "Delete", UniqueID: "delete", DeleteUniqueID: "shape", OpInkCost: 8, Expires: expires}
+
+	// the artist mines its ink, then another miner puts its shape in a block, and a third its delete
+	rewarded := addTestBlock(addTestBlock(genesis, "reward", artist), "rewarded", artist)
+	added := addTestBlock(rewarded, "added", miner, shape)
+	deleted := addTestBlock(added, "deleted", other, remove)
+
+	checkBalances := func(tip string, artistInk, minerInk, otherInk uint32) {
+		if chainState.TipHash() != tip {
+			t.Fatalf("tip is %s, expected %s", chainState.TipHash(), tip)
+		}
+		for _, balance := range []struct {
+			name     string
+			key      *ecdsa.PrivateKey
+			expected uint32
+		}{{"artist", artist, artistInk}, {"miner", miner, minerInk}, {"other", other, otherInk}} {
+			if ink := chainState.Balance(balance.key.PublicKey); ink != balance.expected {
+				t.Errorf("at %s the %s has %d ink, expected %d", tip, balance.name, ink, balance.expected)
+			}
+		}
+	}
+
+	if err := chainState.SwitchTo(added); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances("added", 2, 10, 0)
+
+	// the ink of the deleted shape goes back to the artist
+	if err := chainState.SwitchTo(deleted); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances("deleted", 10, 10, 10)
+
+	// an operation the key can not pay for does not apply
+	expensive := Operation{ArtNodePubKey: artist.PublicKey, OpType: "Add", UniqueID: "expensive", OpInkCost: 11, Expires: expires}
+	err := chainState.SwitchTo(addTestBlock(deleted, "expensive", miner, expensive))
+	if invalid, ok := err.(InvalidBlockError); !ok || invalid.Hash != "expensive" {
+		t.Errorf("switching to a block spending more ink than the key has returns %v", err)
+	} else if _, ok := invalid.Err.(blockartlib.InsufficientInkError); !ok {
+		t.Error("block spending more ink than the key has applies")
+	}
+	checkBalances("deleted", 10, 10, 10)
+
+	// switching to a fork reverts the ledger
+	if err := chainState.SwitchTo(rewarded); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances("rewarded", 10, 0, 0)
+}
+
+// Returns the key in the hex encoded PKIX form of the config.
+func testConfigKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(der)
+}
+
+func TestGenesisAllocationsAndShapes(t *testing.T) {
+	artist := newTestKey(t)
+	settings.Genesis = blockartlib.GenesisSettings{
+		Allocations: []blockartlib.GenesisAllocation{{PubKey: testConfigKey(t, artist), Ink: 300}},
+		Shapes:      []blockartlib.GenesisShape{{PubKey: testConfigKey(t, artist), SvgString: "M 10 10 h 20", Fill: "transparent", Stroke: "red"}},
+	}
+	genesisHash, err := blockartlib.GenesisHash(settings.Genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.GenesisBlockHash = genesisHash
+
+	genesis, err := NewGenesisBlock(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genesis.Hash != settings.GenesisBlockHash || genesis.PathLength != 1 {
+		t.Errorf("genesis block is %s at height %d", genesis.Hash, genesis.PathLength)
+	}
+	if len(genesis.SetOPs) != 1 || genesis.SetOPs[0].UniqueID != genesis.Hash+"-0" || genesis.SetOPs[0].OpInkCost != 0 {
+		t.Fatalf("genesis shapes are %+v", genesis.SetOPs)
+	}
+
+	blockStore = NewBlockStore()
+	chainState = NewChainState()
+	blockStore.Add(genesis)
+	if err := chainState.SwitchTo(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if ink := chainState.Balance(artist.PublicKey); ink != 300 {
+		t.Errorf("artist starts with %d ink, expected 300", ink)
+	}
+	if owner := chainState.Owners[genesis.SetOPs[0].UniqueID]; owner != PubKeyToString(artist.PublicKey) {
+		t.Error("genesis shape is not owned by the artist")
+	}
+
+	// every miner derives the hash from the contents and rejects a config that does not match
+	settings.Genesis.Allocations[0].Ink = 1000
+	if _, err := NewGenesisBlock(settings); err == nil {
+		t.Error("genesis block with changed allocations matches the old hash")
+	}
+	settings.Genesis.Allocations[0].PubKey = "not a key"
+	settings.GenesisBlockHash = ""
+	if _, err := NewGenesisBlock(settings); err == nil {
+		t.Error("genesis allocation with a bad key is accepted")
+	}
+}
+
+// The package state of one miner, so that a test can run several miners in turn.
+type testMiner struct {
+	privKey         ecdsa.PrivateKey
+	pubKey          ecdsa.PublicKey
+	blockStore      *BlockStore
+	orphanPool      *OrphanPool
+	chainState      *ChainState
+	connectedMiners *ConnectedMiners
+	globalChain     []Block
+}
+
+// Resets the package state to a new miner on a chain holding only the genesis block.
+func newTestMiner(t *testing.T) *testMiner {
+	key := newTestKey(t)
+	privKey = *key
+	pubKey = key.PublicKey
+	blockStore = NewBlockStore()
+	orphanPool = NewOrphanPool()
+	chainState = NewChainState()
+	connectedMiners = NewConnectedMiners()
+	globalChain = nil
+
+	genesis := &Block{Hash: "genesis", PathLength: 1, Target: blockartlib.MaxTarget}
+	blockStore.Add(genesis)
+	SetLongestChain(FindLongestChainTip())
+
+	miner := &testMiner{}
+	miner.save()
+	return miner
+}
+
+// Saves the package state into the miner.
+func (miner *testMiner) save() {
+	*miner = testMiner{
+		privKey:         privKey,
+		pubKey:          pubKey,
+		blockStore:      blockStore,
+		orphanPool:      orphanPool,
+		chainState:      chainState,
+		connectedMiners: connectedMiners,
+		globalChain:     globalChain,
+	}
+}
+
+// Makes the package state the one saved in the miner.
+func (miner *testMiner) load() {
+	privKey = miner.privKey
+	pubKey = miner.pubKey
+	blockStore = miner.blockStore
+	orphanPool = miner.orphanPool
+	chainState = miner.chainState
+	connectedMiners = miner.connectedMiners
+	globalChain = miner.globalChain
+}
+
+// Stores a copy of the block on top of its stored parent and moves to the chain with the most
+// work, as a miner does with a block it receives.
+func receiveTestBlock(t *testing.T, block Block) {
+	parent, exists := blockStore.Get(block.PreviousHash)
+	if !exists {
+		t.Fatal("parent of " + block.Hash + " is not stored")
+	}
+	block.PreviousBlock = parent
+	block.PathLength = parent.PathLength + 1
+	blockStore.Add(&block)
+	SetLongestChain(FindLongestChainTip())
+}
+
+// Two miners that see two blocks with the same work in different orders each stay on the one they
+// saw first, and both move to the chain that gets the next block.
+func TestMinersConvergeOnEqualWorkForks(t *testing.T) {
+	first := newTestMiner(t)
+	second := newTestMiner(t)
+	current := second
+	use := func(miner *testMiner) {
+		current.save()
+		miner.load()
+		current = miner
+	}
+
+	// mined by two other miners on the genesis block
+	x := Block{Hash: "x", PreviousHash: "genesis", MinerPubKey: newTestKey(t).PublicKey, Target: blockartlib.MaxTarget}
+	y := Block{Hash: "y", PreviousHash: "genesis", MinerPubKey: newTestKey(t).PublicKey, Target: blockartlib.MaxTarget}
+	if BlockWork(x).Cmp(BlockWork(y)) != 0 {
+		t.Fatal("forks do not have the same work")
+	}
+
+	use(first)
+	receiveTestBlock(t, x)
+	receiveTestBlock(t, y)
+	use(second)
+	receiveTestBlock(t, y)
+	receiveTestBlock(t, x)
+
+	for _, seen := range []struct {
+		miner *testMiner
+		tip   string
+	}{{first, "x"}, {second, "y"}} {
+		use(seen.miner)
+		if tip := chainState.TipHash(); tip != seen.tip {
+			t.Errorf("tip is %s, expected the block seen first %s", tip, seen.tip)
+		}
+		if prevBlock := SelectBranch(FindMostWorkTips()); prevBlock.Hash != seen.tip {
+			t.Errorf("miner builds on %s, expected the block seen first %s", prevBlock.Hash, seen.tip)
+		}
+	}
+
+	// the second miner finds the next block and sends it to the first
+	z := Block{Hash: "z", PreviousHash: "y", MinerPubKey: second.pubKey, Target: blockartlib.MaxTarget}
+	use(second)
+	receiveTestBlock(t, z)
+	use(first)
+	receiveTestBlock(t, z)
+
+	for _, miner := range []*testMiner{first, second} {
+		use(miner)
+		if tip := chainState.TipHash(); tip != "z" {
+			t.Errorf("tip is %s, expected z", tip)
+		}
+	}
+}
+
+// Miners whose chain state is on none of the tips with the most work, as after storing blocks
+// without moving the state, all pick the tip with the lowest hash, whatever order they got the
+// tips in.
+func TestMinersPickLowestHashWithoutFirstSeenTip(t *testing.T) {
+	first := newTestMiner(t)
+	second := newTestMiner(t)
+	current := second
+	use := func(miner *testMiner) {
+		current.save()
+		miner.load()
+		current = miner
+	}
+
+	x := Block{Hash: "x", PreviousHash: "genesis", Target: blockartlib.MaxTarget}
+	y := Block{Hash: "y", PreviousHash: "genesis", Target: blockartlib.MaxTarget}
+	for _, order := range []struct {
+		miner  *testMiner
+		blocks []Block
+	}{{first, []Block{y, x}}, {second, []Block{x, y}}} {
+		use(order.miner)
+		for i := range order.blocks {
+			block := order.blocks[i]
+			block.PreviousBlock = blockStore.Genesis()
+			block.PathLength = block.PreviousBlock.PathLength + 1
+			blockStore.Add(&block)
+		}
+
+		if prevBlock := SelectBranch(FindMostWorkTips()); prevBlock.Hash != "x" {
+			t.Errorf("miner builds on %s, expected the lowest hash x", prevBlock.Hash)
+		}
+	}
+}
+
+// Stores a chain of no-op blocks on genesis, mined spacing milliseconds apart, and returns its tip.
+func addTestChain(t *testing.T, genesis *Block, length int, spacing int64) *Block {
+	miner := newTestKey(t)
+	tip := genesis
+	for i := 0; i < length; i++ {
+		tip = addTestBlock(tip, fmt.Sprint(spacing, "-", tip.PathLength+1), miner)
+		tip.Timestamp = int64(tip.PathLength) * spacing
+	}
+	return tip
+}
+
+func TestRetargetTowardBlockInterval(t *testing.T) {
+	settings.TargetBlockInterval = 1000
+	settings.RetargetWindow = 4
+	settings.PoWDifficultyOpBlock = 2
+	settings.PoWDifficultyNoOpBlock = 1
+	base := blockartlib.DifficultyTarget(2)
+
+	for _, test := range []struct {
+		name     string
+		spacing  int64
+		expected *big.Int
+	}{
+		{"on time", 1000, base},
+		{"twice as fast", 500, new(big.Int).Div(base, big.NewInt(2))},
+		{"twice as slow", 2000, new(big.Int).Mul(base, big.NewInt(2))},
+		{"far too slow", 100000, new(big.Int).Mul(base, big.NewInt(blockartlib.MaxRetargetFactor))},
+	} {
+		blockStore = NewBlockStore()
+		genesis := &Block{Hash: "genesis", PathLength: 1, Target: base}
+		blockStore.Add(genesis)
+
+		// the target changes only after every window of blocks, and not in the first one
+		tip := addTestChain(t, genesis, 6, test.spacing)
+		if target := NextTarget(tip.PreviousBlock); target.Cmp(base) != 0 {
+			t.Errorf("%s: target changed inside a window", test.name)
+		}
+		if target := NextTarget(tip.PreviousBlock.PreviousBlock.PreviousBlock); target.Cmp(base) != 0 {
+			t.Errorf("%s: target changed after the first window", test.name)
+		}
+
+		tip = addTestChain(t, tip, 1, test.spacing)
+		if target := NextTarget(tip); target.Cmp(test.expected) != 0 {
+			t.Errorf("%s: target is %x, expected %x", test.name, target, test.expected)
+		}
+	}
+
+	// op blocks keep the ratio of the configured difficulties, a finer step than a hex zero
+	opTarget := blockartlib.BlockTarget(base, true, settings)
+	ratio := new(big.Int).Div(new(big.Int).Add(base, big.NewInt(1)), new(big.Int).Add(opTarget, big.NewInt(1)))
+	if ratio.Cmp(big.NewInt(16)) != 0 {
+		t.Errorf("op block target is 1/%s of the no-op block target, expected 1/16", ratio)
+	}
+	halved := new(big.Int).Div(base, big.NewInt(2))
+	if blockartlib.TargetWork(halved).Cmp(new(big.Int).Mul(blockartlib.TargetWork(base), big.NewInt(2))) != 0 {
+		t.Error("halving the target does not double the work")
+	}
+}
+
+func TestCheckBlockTarget(t *testing.T) {
+	settings.TargetBlockInterval = 1000
+	settings.RetargetWindow = 4
+	blockStore = NewBlockStore()
+	genesis := &Block{Hash: "genesis", PathLength: 1, Target: blockartlib.DifficultyTarget(1)}
+	blockStore.Add(genesis)
+	parent := addTestChain(t, genesis, 3, 1000)
+
+	block := Block{PreviousHash: parent.Hash, Target: NextTarget(parent), Timestamp: parent.Timestamp + 1000}
+	if err := CheckBlockTarget(block, parent); err != nil {
+		t.Error(err)
+	}
+
+	easier := block
+	easier.Target = new(big.Int).Mul(block.Target, big.NewInt(2))
+	if err := CheckBlockTarget(easier, parent); err == nil {
+		t.Error("block with an easier target than its parent calls for is valid")
+	}
+
+	early := block
+	early.Timestamp = MedianTimePast(parent)
+	if err := CheckBlockTarget(early, parent); err == nil {
+		t.Error("block timestamped at the median time past is valid")
+	}
+}
+
+func TestBlockHashCoversHeaderAndOperations(t *testing.T) {
+	settings = blockartlib.MinerNetSettings{}
+	artist := newTestKey(t)
+	op := Operation{ArtNodePubKey: artist.PublicKey, OpType: "Add", ShapeSvgString: "M 10 10 h 20", Fill: "transparent", Stroke: "red", OpInkCost: 20}
+	if err := blockartlib.SignOperation(&op, *artist); err != nil {
+		t.Fatal(err)
+	}
+	block := Block{
+		Version:      blockartlib.BlockVersion,
+		PreviousHash: "parent",
+		SetOPs:       []Operation{op},
+		MinerPubKey:  newTestKey(t).PublicKey,
+		Nonce:        7,
+		Timestamp:    1000,
+		Target:       blockartlib.MaxTarget,
+	}
+	block.MerkleRoot = blockartlib.MerkleRoot(block.SetOPs)
+	block.Hash = ComputeBlockHash(block)
+	if len(block.Hash) != 2*sha256.Size {
+		t.Errorf("block hash %s is not a SHA-256 hash", block.Hash)
+	}
+	if err := CheckBlockHash(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// every header field changes the hash
+	for name, change := range map[string]func(block *Block){
+		"version":       func(block *Block) { block.Version++ },
+		"previous hash": func(block *Block) { block.PreviousHash = "other" },
+		"Merkle root":   func(block *Block) { block.MerkleRoot = blockartlib.MerkleRoot(nil) },
+		"miner key":     func(block *Block) { block.MinerPubKey = artist.PublicKey },
+		"nonce":         func(block *Block) { block.Nonce++ },
+		"timestamp":     func(block *Block) { block.Timestamp++ },
+		"target":        func(block *Block) { block.Target = blockartlib.DifficultyTarget(1) },
+	} {
+		changed := block
+		change(&changed)
+		if ComputeBlockHash(changed) == block.Hash {
+			t.Errorf("changing the %s does not change the block hash", name)
+		}
+	}
+
+	// so does every field of an operation, through the Merkle root
+	for name, change := range map[string]func(op *Operation){
+		"svg string": func(op *Operation) { op.ShapeSvgString = "M 10 10 h 30" },
+		"fill":       func(op *Operation) { op.Fill = "red" },
+		"stroke":     func(op *Operation) { op.Stroke = "blue" },
+		"ink cost":   func(op *Operation) { op.OpInkCost = 1 },
+		"shape type": func(op *Operation) { op.ShapeType = blockartlib.PATH + 1 },
+		"unique id":  func(op *Operation) { op.UniqueID = "other" },
+	} {
+		changed := block
+		changed.SetOPs = []Operation{op}
+		change(&changed.SetOPs[0])
+		if err := CheckBlockHeader(changed); err == nil {
+			t.Errorf("block with a changed operation %s matches its header", name)
+		}
+	}
+}
+
+func TestUnknownBlockVersionIsRejected(t *testing.T) {
+	settings = blockartlib.MinerNetSettings{}
+	block := Block{Version: blockartlib.BlockVersion, PreviousHash: "parent", Target: blockartlib.MaxTarget}
+	block.MerkleRoot = blockartlib.MerkleRoot(nil)
+	block.Hash = ComputeBlockHash(block)
+	if err := CheckBlockHash(block); err != nil {
+		t.Fatal(err)
+	}
+
+	block.Version++
+	block.Hash = ComputeBlockHash(block)
+	if err := CheckBlockHeader(block); err == nil {
+		t.Error("block with an unknown version is valid")
+	}
+	if err := CheckBlockHash(block); err == nil {
+		t.Error("block with an unknown version has a valid hash")
+	}
+
+	block.Version = 0
+	block.Hash = ComputeBlockHash(block)
+	if err := CheckBlockHash(block); err == nil {
+		t.Error("block without a version has a valid hash")
+	}
+}
+
+// Resets the miner to a chain holding only the genesis block, which gives ink to every key in
+// allocated. The miner mines with a key of its own.
+func newTestChain(t *testing.T, allocated ...*ecdsa.PrivateKey) {
+	genesis := blockartlib.GenesisSettings{}
+	for _, key := range allocated {
+		genesis.Allocations = append(genesis.Allocations, blockartlib.GenesisAllocation{PubKey: testConfigKey(t, key), Ink: 1000})
+	}
+
+	genesisHash, err := blockartlib.GenesisHash(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings = blockartlib.MinerNetSettings{
+		GenesisBlockHash:       genesisHash,
+		InkPerOpBlock:          10,
+		InkPerNoOpBlock:        5,
+		PoWDifficultyOpBlock:   1,
+		PoWDifficultyNoOpBlock: 1,
+		CanvasSettings:         blockartlib.CanvasSettings{CanvasXMax: 1024, CanvasYMax: 1024},
+		Genesis:                genesis,
+	}
+
+	minerKey := newTestKey(t)
+	privKey = *minerKey
+	pubKey = minerKey.PublicKey
+	tcpAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}
+
+	blockStore = NewBlockStore()
+	orphanPool = NewOrphanPool()
+	mempool = NewMempool()
+	operationWatch = NewOperationWatch()
+	chainState = NewChainState()
+	connectedMiners = NewConnectedMiners()
+	artNodeSessions = ArtNodeSessions{all: make(map[int]*ArtNodeSession)}
+	globalChain = nil
+	chainFile = nil
+	DrainMiningEvents()
+
+	block, err := NewGenesisBlock(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockStore.Add(block)
+	SetLongestChain(FindLongestChainTip())
+}
+
+// Returns a signed operation adding the path to the canvas.
+func newTestShape(t *testing.T, key *ecdsa.PrivateKey, svg string) Operation {
+	lines, ink, err := blockartlib.ParseShape(svg, "transparent", "red", settings.CanvasSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := Operation{
+		ArtNodeID:      1,
+		ArtNodePubKey:  key.PublicKey,
+		OpInkCost:      ink,
+		OpType:         "Add",
+		ValidateNum:    1,
+		ShapeType:      blockartlib.PATH,
+		ShapeSvgString: svg,
+		Fill:           "transparent",
+		Stroke:         "red",
+		Lines:          lines,
+		PathShape:      blockartlib.ConstructSvgString(blockartlib.PATH, svg, "transparent", "red"),
+		Expires:        testExpiry(time.Now()),
+	}
+	if err := blockartlib.SignOperation(&op, *key); err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+// Returns a signed operation deleting the shape added by op.
+func newTestDelete(t *testing.T, key *ecdsa.PrivateKey, op Operation) Operation {
+	deleteOp := Operation{
+		ArtNodeID:      1,
+		ArtNodePubKey:  key.PublicKey,
+		OpInkCost:      op.OpInkCost,
+		OpType:         "Delete",
+		ValidateNum:    1,
+		ShapeType:      op.ShapeType,
+		ShapeSvgString: op.ShapeSvgString,
+		Fill:           "white",
+		Stroke:         "white",
+		DeleteUniqueID: op.UniqueID,
+		Expires:        testExpiry(time.Now()),
+	}
+	if err := blockartlib.SignOperation(&deleteOp, *key); err != nil {
+		t.Fatal(err)
+	}
+	return deleteOp
+}
+
+// Returns the expiry an art node signing an operation at the time gives it.
+func testExpiry(signed time.Time) int64 {
+	return signed.Add(blockartlib.OperationLifetime).UnixNano() / int64(time.Millisecond)
+}
+
+// Returns the UniqueIDs of the operations.
+func operationIDs(ops []Operation) []string {
+	ids := []string{}
+	for _, op := range ops {
+		ids = append(ids, op.UniqueID)
+	}
+	return ids
+}
+
+func TestMempoolDedupesAndExpires(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	first := newTestShape(t, artist, "M 10 10 h 20")
+	second := newTestShape(t, artist, "M 10 50 h 20")
+
+	pool := NewMempool()
+	if !pool.Add(first) || !pool.Add(second) {
+		t.Fatal("new operations are not added")
+	}
+	if pool.Add(first) {
+		t.Error("operation is added twice")
+	}
+	if pool.Added() != 2 || !pool.Seen(first.UniqueID) {
+		t.Errorf("%d operations added, expected 2", pool.Added())
+	}
+	if ids := operationIDs(pool.Pending()); fmt.Sprint(ids) != fmt.Sprint(operationIDs([]Operation{first, second})) {
+		t.Errorf("pending operations are not in arrival order")
+	}
+
+	// an operation on the chain leaves the mempool but stays seen
+	pool.Remove(first.UniqueID)
+	if pool.Add(first) {
+		t.Error("operation on the chain is added again when it is flooded back")
+	}
+	if ids := operationIDs(pool.Pending()); len(ids) != 1 || ids[0] != second.UniqueID {
+		t.Errorf("pending operations are %v after removing one", ids)
+	}
+	pool.Restore(first)
+	pool.Restore(first)
+	if pending := pool.Pending(); len(pending) != 2 {
+		t.Errorf("%d operations pending after restoring one, expected 2", len(pending))
+	}
+
+	pool.Lock()
+	pool.expire(time.Now().Add(MempoolExpiry + time.Second))
+	pool.Unlock()
+	if pending := pool.Pending(); len(pending) != 0 || !pool.Seen(first.UniqueID) {
+		t.Errorf("%d operations pending after they expired, expected none that are not seen", len(pending))
+	}
+	pool.Lock()
+	pool.expire(time.Now().Add(SeenOperationExpiry + time.Second))
+	pool.Unlock()
+	if pool.Seen(first.UniqueID) || !pool.Add(first) {
+		t.Error("operation is still seen after SeenOperationExpiry")
+	}
+}
+
+func TestSelectValidOperationsPicksNonConflictingSet(t *testing.T) {
+	artist, other := newTestKey(t), newTestKey(t)
+	newTestChain(t, artist, other)
+
+	first := newTestShape(t, artist, "M 10 10 h 400")
+	crossing := newTestShape(t, other, "M 100 0 v 100")
+	second := newTestShape(t, other, "M 10 200 h 300")
+	tooExpensive := newTestShape(t, artist, "M 10 300 h 700")
+	third := newTestShape(t, artist, "M 10 400 h 500")
+	if first.OpInkCost+tooExpensive.OpInkCost <= 1000 || first.OpInkCost+third.OpInkCost > 1000 {
+		t.Fatal("shapes do not cost the ink the test needs")
+	}
+
+	// all but the shape crossing the first one and the one the artist can not pay for any more
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	selected := SelectValidOperations(blockStore.Genesis(), now, []Operation{first, crossing, second, tooExpensive, third})
+	if ids, expected := fmt.Sprint(operationIDs(selected)), fmt.Sprint(operationIDs([]Operation{first, second, third})); ids != expected {
+		t.Errorf("selected %s, expected %s", ids, expected)
+	}
+
+	many := []Operation{}
+	for i := 0; i < MaxBlockOperations+1; i++ {
+		many = append(many, newTestShape(t, other, fmt.Sprintf("M %d 600 v 1", i*2)))
+	}
+	if selected := SelectValidOperations(blockStore.Genesis(), now, many); len(selected) != MaxBlockOperations {
+		t.Errorf("selected %d operations, expected at most %d", len(selected), MaxBlockOperations)
+	}
+
+	// a block timestamped after an operation expired can not take it
+	if selected := SelectValidOperations(blockStore.Genesis(), first.Expires+1, []Operation{first}); len(selected) != 0 {
+		t.Error("expired operation is selected")
+	}
+}
+
+func TestReorgPutsOperationsBackInMempool(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	genesis := blockStore.Genesis()
+	kept := newTestShape(t, artist, "M 10 10 h 20")
+	dropped := newTestShape(t, artist, "M 10 50 h 20")
+	mempool.Add(kept)
+	mempool.Add(dropped)
+
+	// both operations go in a block, then a longer fork has only one of them
+	withBoth := addTestBlock(genesis, "both", newTestKey(t), kept, dropped)
+	SetLongestChain(withBoth)
+	if pending := mempool.Pending(); len(pending) != 0 {
+		t.Fatalf("%d operations pending after they went in a block", len(pending))
+	}
+
+	fork := addTestBlock(addTestBlock(genesis, "kept", newTestKey(t), kept), "fork", newTestKey(t))
+	SetLongestChain(fork)
+	if ids := operationIDs(mempool.Pending()); len(ids) != 1 || ids[0] != dropped.UniqueID {
+		t.Errorf("pending operations are %v, expected only the one the fork does not have", ids)
+	}
+}
+
+func TestMineBlockOnParallelWorkers(t *testing.T) {
+	settings = blockartlib.MinerNetSettings{}
+	template := Block{Version: blockartlib.BlockVersion, PreviousHash: "parent", MerkleRoot: blockartlib.MerkleRoot(nil), Timestamp: 1000}
+	target := blockartlib.DifficultyTarget(2)
+	template.Target = target
+
+	block, found := MineBlock(template, target, 4, nil)
+	if !found {
+		t.Fatal("no block mined")
+	}
+	if block.Hash != ComputeBlockHash(block) || !blockartlib.HashMeetsTarget(block.Hash, target) {
+		t.Errorf("mined hash %s does not match the block or does not meet the target", block.Hash)
+	}
+
+	// the extra-nonce is part of the header, so workers with different extra-nonces never hash the same header
+	other := block
+	other.ExtraNonce++
+	if ComputeBlockHash(other) == block.Hash {
+		t.Error("extra-nonce does not change the block hash")
+	}
+}
+
+func TestMineBlockStopsWhenNotified(t *testing.T) {
+	settings = blockartlib.MinerNetSettings{}
+	template := Block{Version: blockartlib.BlockVersion, PreviousHash: "parent", Target: blockartlib.MaxTarget}
+	DrainMiningEvents()
+	atomic.SwapUint64(&hashCount, 0)
+
+	// no hash meets a zero target
+	done := make(chan bool)
+	go func() {
+		_, found := MineBlock(template, big.NewInt(0), 2, miningEvents)
+		done <- found
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	NotifyMiner()
+	NotifyMiner()
+	select {
+	case found := <-done:
+		if found {
+			t.Error("block found for a zero target")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miner did not stop when notified")
+	}
+	if atomic.LoadUint64(&hashCount) == 0 {
+		t.Error("hashes are not counted for the hash rate")
+	}
+}
+
+func TestNewOperationsAndTipsNotifyMiner(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	DrainMiningEvents()
+	var reply bool
+	if err := new(MinerKey).ReceiveOperation(newTestShape(t, artist, "M 10 10 h 20"), &reply); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-miningEvents:
+	default:
+		t.Error("miner is not notified of a new operation")
+	}
+
+	tip := addTestBlock(blockStore.Genesis(), "tip", newTestKey(t))
+	SetLongestChain(tip)
+	select {
+	case <-miningEvents:
+	default:
+		t.Error("miner is not notified of a new tip")
+	}
+	SetLongestChain(tip)
+	select {
+	case <-miningEvents:
+		t.Error("miner is notified when the tip stays the same")
+	default:
+	}
+}
+
+func eventTypes(events []blockartlib.OperationEvent) []string {
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestOperationWatchReportsReorgs(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	genesis := blockStore.Genesis()
+	owner := PubKeyToString(artist.PublicKey)
+	op := newTestShape(t, artist, "M 10 10 h 20")
+
+	confirmed := addTestBlock(genesis, "confirmed", newTestKey(t), op)
+	SetLongestChain(confirmed)
+	operationWatch.Watch(op)
+
+	// a longer fork without the operation drops it back into the mempool
+	fork := addTestBlock(addTestBlock(genesis, "fork1", newTestKey(t)), "fork2", newTestKey(t))
+	SetLongestChain(fork)
+	events := operationWatch.Events(owner, 0)
+	if types := eventTypes(events); len(types) != 1 || types[0] != blockartlib.OpDropped {
+		t.Fatalf("events after the reorg are %v, expected a drop", types)
+	}
+	if !mempool.Contains(op.UniqueID) {
+		t.Error("dropped operation is not back in the mempool")
+	}
+
+	// mined again on the new chain
+	remined := addTestBlock(fork, "remined", newTestKey(t), op)
+	SetLongestChain(remined)
+	events = operationWatch.Events(owner, events[0].Seq)
+	if len(events) != 1 || events[0].Type != blockartlib.OpReincluded || events[0].BlockHash != "remined" {
+		t.Fatalf("events after mining again are %+v, expected a reinclusion in remined", events)
+	}
+	if other := operationWatch.Events(PubKeyToString(newTestKey(t).PublicKey), 0); len(other) != 0 {
+		t.Errorf("another key sees %d events of the operation", len(other))
+	}
+
+	// deep enough, the operation is no longer watched
+	SetLongestChain(addTestChain(t, remined, WatchedOperationDepth, 1))
+	operationWatch.Lock()
+	_, watched := operationWatch.watched[op.UniqueID]
+	operationWatch.Unlock()
+	if watched {
+		t.Error("operation is still watched once it is buried")
+	}
+}
+
+func TestOperationWatchInvalidatesExpiredOperations(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	genesis := blockStore.Genesis()
+	op := newTestShape(t, artist, "M 10 10 h 20")
+
+	SetLongestChain(addTestBlock(genesis, "confirmed", newTestKey(t), op))
+	operationWatch.Watch(op)
+	SetLongestChain(addTestBlock(addTestBlock(genesis, "fork1", newTestKey(t)), "fork2", newTestKey(t)))
+
+	// the operation waits in the mempool until it expires
+	mempool.Remove(op.UniqueID)
+	operationWatch.Update()
+	events := operationWatch.Events(PubKeyToString(artist.PublicKey), 0)
+	if types := eventTypes(events); len(types) != 2 || types[1] != blockartlib.OpInvalidated {
+		t.Errorf("events are %v, expected a drop then an invalidation", types)
+	}
+}
+
+// Mines a block with the operations on top of parent, the way another miner would send it.
+func mineTestBlock(t *testing.T, parent *Block, ops []Operation) Block {
+	return mineTestBlockAt(t, parent, ops, time.Now())
+}
+
+// Mines a block like mineTestBlock, timestamped at mined (or just after the median time past).
+func mineTestBlockAt(t *testing.T, parent *Block, ops []Operation, mined time.Time) Block {
+	template := Block{
+		Version:      blockartlib.BlockVersion,
+		PreviousHash: parent.Hash,
+		MinerPubKey:  pubKey,
+		SetOPs:       ops,
+		MerkleRoot:   blockartlib.MerkleRoot(ops),
+		Target:       NextTarget(parent),
+		Timestamp:    mined.UnixNano() / int64(time.Millisecond),
+	}
+	if medianTime := MedianTimePast(parent); template.Timestamp <= medianTime {
+		template.Timestamp = medianTime + 1
+	}
+
+	block, found := MineBlock(template, RequiredTarget(template), 1, nil)
+	if !found {
+		t.Fatal("no block mined")
+	}
+	return block
+}
+
+// Runs art node RPCs, blocks and operations received from other miners, and the miner itself all
+// at once, so that `go test -race` catches state shared without holding its lock.
+func TestConcurrentRPCBlocksAndMining(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	settings.CheckpointInterval = 3
+
+	workers := miningWorkers
+	miningWorkers = 2
+	defer func() { miningWorkers = workers }()
+
+	// a fork of no-op blocks from another miner, received while this miner mines its own chain
+	var fork []Block
+	parent := blockStore.Genesis()
+	for i := 0; i < 8; i++ {
+		block := mineTestBlock(t, parent, []Operation{})
+		block.PreviousBlock = parent
+		block.PathLength = parent.PathLength + 1
+		fork = append(fork, block)
+		parent = &fork[len(fork)-1]
+	}
+	for i := range fork {
+		fork[i].PreviousBlock = nil
+		fork[i].PathLength = 0
+	}
+
+	var added, received []Operation
+	for i := 0; i < 4; i++ {
+		added = append(added, newTestShape(t, artist, fmt.Sprintf("M %d 10 h 20", 10+40*i)))
+		received = append(received, newTestShape(t, artist, fmt.Sprintf("M %d 100 h 20", 10+40*i)))
+	}
+
+	stop := make(chan struct{})
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var mining, writers, readers sync.WaitGroup
+	// one miner, like GenerateBlock, with several workers
+	mining.Add(1)
+	go func() {
+		defer mining.Done()
+		for !stopped() {
+			MineNextBlock()
+		}
+	}()
+
+	// art nodes adding shapes wait for them to be validated by the running miner
+	for _, op := range added {
+		writers.Add(1)
+		go func(op Operation) {
+			defer writers.Done()
+			artKey := &ArtKey{Session: &ArtNodeSession{ArtNodeID: 1, PubKey: artist.PublicKey}}
+			var block Block
+			if err := artKey.AddShape(op, &block); err != nil {
+				t.Error(err)
+			} else if block.Hash == "" {
+				t.Errorf("shape %s was not validated", op.ShapeSvgString)
+			}
+		}(op)
+	}
+
+	// art nodes reading the canvas, and connecting and disconnecting
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for !stopped() {
+				artKey := &ArtKey{}
+				var nonce []byte
+				if err := artKey.GetNonce("", &nonce); err != nil {
+					t.Error(err)
+					return
+				}
+				r, s, err := ecdsa.Sign(rand.Reader, artist, nonce)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var canvas blockartlib.CanvasSettings
+				key := blockartlib.ArtNodeKey{ArtNodeID: 1, PubKey: artist.PublicKey, R: r, S: s, Hash: nonce}
+				if err := artKey.ValidateKey(key, &canvas); err != nil {
+					// the other readers may hold every session
+					continue
+				}
+
+				var ink uint32
+				var headers []blockartlib.BlockHeader
+				var header blockartlib.BlockHeader
+				var shapes []string
+				var operations []Operation
+				var operation Operation
+				var proof blockartlib.OperationProof
+				var history []blockartlib.ShapeEvent
+				var events []blockartlib.OperationEvent
+				var children []string
+				var sessions []blockartlib.SessionStatus
+				tip := chainState.TipHash()
+				artKey.GetInk("", &ink)
+				artKey.GetHeaders(nil, &headers)
+				artKey.GetHeader(tip, &header)
+				artKey.GetShapes(tip, &shapes)
+				artKey.GetBlockOperations(tip, &operations)
+				artKey.GetChildren(settings.GenesisBlockHash, &children)
+				artKey.GetOperationEvents(0, &events)
+				artKey.GetSessions("", &sessions)
+				for _, shape := range shapes {
+					artKey.GetOperationWithShapeHash(shape, &operation)
+					artKey.GetOperationProof(shape, &proof)
+					artKey.GetShapeHistory(shape, &history)
+				}
+				artKey.CloseCanvas("", &ink)
+			}
+		}()
+	}
+
+	// other miners sending their fork in either order, and operations and their headers
+	minerKey := new(MinerKey)
+	for _, reverse := range []bool{false, true} {
+		writers.Add(1)
+		go func(reverse bool) {
+			defer writers.Done()
+			for i := range fork {
+				block := fork[i]
+				if reverse {
+					block = fork[len(fork)-1-i]
+				}
+				var reply string
+				if err := minerKey.ReceiveBlock(BlockMessage{Block: block}, &reply); err != nil {
+					t.Error(err)
+				}
+			}
+		}(reverse)
+	}
+	for _, op := range received {
+		writers.Add(1)
+		go func(op Operation) {
+			defer writers.Done()
+			var reply bool
+			if err := minerKey.ReceiveOperation(op, &reply); err != nil {
+				t.Error(err)
+			}
+			var headers []BlockHeader
+			minerKey.GetHeaders(nil, &headers)
+			var blocks []Block
+			minerKey.GetBlocks([]string{chainState.TipHash()}, &blocks)
+		}(op)
+	}
+
+	// the readers and the miner stop once every shape is validated and the fork is received
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	for finished := waitGroupDone(&mining); ; {
+		NotifyMiner()
+		select {
+		case <-finished:
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	chainLock.RLock()
+	defer chainLock.RUnlock()
+	forkTip, exists := blockStore.Get(fork[len(fork)-1].Hash)
+	if !exists {
+		t.Fatal("tip of the fork is not stored")
+	}
+	if forkTip.PathLength != blockStore.Genesis().PathLength+len(fork) {
+		t.Errorf("tip of the fork is at height %d, expected %d", forkTip.PathLength, blockStore.Genesis().PathLength+len(fork))
+	}
+
+	// the chain switched to the block with the most work, at the height of its path to genesis
+	best := blockStore.Best()
+	if chainState.Tip != best.Hash || globalChain[len(globalChain)-1].Hash != best.Hash {
+		t.Errorf("tip is %s, expected the best block %s", chainState.Tip, best.Hash)
+	}
+	height := 0
+	for block := best; block != nil; block = block.PreviousBlock {
+		height++
+	}
+	if best.PathLength != height || chainState.Height != height || len(globalChain) != height {
+		t.Errorf("tip is at height %d (chain state %d, %d blocks), expected %d", best.PathLength, chainState.Height, len(globalChain), height)
+	}
+	if best.TotalWork.Cmp(forkTip.TotalWork) < 0 {
+		t.Errorf("tip %s has less work than the tip of the fork %s", best.Hash, forkTip.Hash)
+	}
+	for _, op := range append(added, received...) {
+		if _, exists := chainState.Shapes[op.UniqueID]; !exists && !mempool.Contains(op.UniqueID) {
+			t.Errorf("shape %s is neither on the chain nor pending", op.ShapeSvgString)
+		}
+	}
+}
+
+// Returns a channel that is closed when every goroutine of the wait group is done.
+func waitGroupDone(wg *sync.WaitGroup) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func storedBlock(t *testing.T, hash string) *Block {
+	block, exists := blockStore.Get(hash)
+	if !exists {
+		t.Fatal("block " + hash + " is not stored")
+	}
+	return block
+}
+
+func TestMalleatedOperationIsRejected(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	op := newTestShape(t, artist, "M 10 10 h 20")
+	block := mineTestBlock(t, blockStore.Genesis(), []Operation{op})
+	if err := AcceptBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	inkLeft := chainState.Balance(artist.PublicKey)
+
+	// (R, N - S) verifies against the same digest; as a new UniqueID it would spend the ink again
+	replay := op
+	replay.OPSigS = new(big.Int).Sub(artist.Curve.Params().N, op.OPSigS)
+	replay.UniqueID = replay.OPSigR.String() + replay.OPSigS.String()
+	if !ecdsa.Verify(&artist.PublicKey, blockartlib.OperationDigest(replay), replay.OPSigR, replay.OPSigS) {
+		t.Fatal("malleated signature does not verify")
+	}
+
+	if blockartlib.VerifyOperation(replay) {
+		t.Error("VerifyOperation accepts a high S signature")
+	}
+	if err := ValidateOperation(replay, chainState); err == nil {
+		t.Error("replayed operation is valid")
+	}
+
+	replayBlock := mineTestBlock(t, storedBlock(t, block.Hash), []Operation{replay})
+	if err := AcceptBlock(replayBlock); err == nil {
+		t.Error("block with the replayed operation was accepted")
+	}
+	if ink := chainState.Balance(artist.PublicKey); ink != inkLeft {
+		t.Errorf("ink changed from %d to %d", inkLeft, ink)
+	}
+}
+
+func TestWithChainRestoresState(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	op := newTestShape(t, artist, "M 10 10 h 20")
+	block := mineTestBlock(t, blockStore.Genesis(), []Operation{op})
+	if err := AcceptBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	tip := chainState.TipHash()
+	inkLeft := chainState.Balance(artist.PublicKey)
+
+	// a competing branch with the same work; the first block seen stays the tip
+	fork := mineTestBlock(t, blockStore.Genesis(), []Operation{})
+	if err := AcceptBlock(fork); err != nil {
+		t.Fatal(err)
+	}
+
+	err := chainState.WithChain(storedBlock(t, fork.Hash), func(state *ChainState) error {
+		if _, exists := state.Shapes[op.UniqueID]; exists {
+			t.Error("shape of the other branch is on the fork")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash := chainState.TipHash(); hash != tip {
+		t.Errorf("tip moved from %s to %s", tip, hash)
+	}
+	if ink := chainState.Balance(artist.PublicKey); ink != inkLeft {
+		t.Errorf("ink changed from %d to %d", inkLeft, ink)
+	}
+	if chainState.OperationBlock(op.UniqueID) != block.Hash {
+		t.Error("operation is no longer on the chain")
+	}
+}
+
+func TestNoOpBlockOnInvalidChainIsRejected(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	// a block spending more ink than the artist has, stored without being checked
+	op := newTestShape(t, artist, "M 10 10 h 20")
+	op.OpInkCost = 5000
+	if err := blockartlib.SignOperation(&op, *artist); err != nil {
+		t.Fatal(err)
+	}
+	invalid := mineTestBlock(t, blockStore.Genesis(), []Operation{op})
+	invalid.PreviousBlock = blockStore.Genesis()
+	invalid.PathLength = invalid.PreviousBlock.PathLength + 1
+	blockStore.Add(&invalid)
+
+	noOp := mineTestBlock(t, &invalid, []Operation{})
+	if err := AcceptBlock(noOp); err == nil {
+		t.Error("block without operations on an invalid chain was accepted")
+	}
+	if chainState.OperationBlock(op.UniqueID) != "" {
+		t.Error("operation of the invalid block is on the chain")
+	}
+}
+
+func TestInvalidBranchFallsBackToValidTip(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	valid := mineTestBlock(t, blockStore.Genesis(), []Operation{})
+	if err := AcceptBlock(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	// a branch with more work whose first block spends more ink than the artist has, stored
+	// without being checked the way a block from an older chain file would be
+	op := newTestShape(t, artist, "M 10 10 h 20")
+	op.OpInkCost = 5000
+	if err := blockartlib.SignOperation(&op, *artist); err != nil {
+		t.Fatal(err)
+	}
+	parent := blockStore.Genesis()
+	var invalid []*Block
+	for _, ops := range [][]Operation{{op}, {}} {
+		block := mineTestBlock(t, parent, ops)
+		block.PreviousBlock = parent
+		block.PathLength = parent.PathLength + 1
+		blockStore.Add(&block)
+		invalid = append(invalid, &block)
+		parent = &block
+	}
+	if blockStore.Best() != parent {
+		t.Fatal("invalid branch does not have the most work")
+	}
+
+	SetLongestChain(FindLongestChainTip())
+	if tip := chainState.TipHash(); tip != valid.Hash {
+		t.Fatalf("tip is %s, expected %s", tip, valid.Hash)
+	}
+	for _, block := range invalid {
+		if !blockStore.IsInvalid(block.Hash) {
+			t.Errorf("block %s is not marked invalid", block.Hash)
+		}
+	}
+	if best := blockStore.Best(); best.Hash != valid.Hash {
+		t.Errorf("best block is %s, expected %s", best.Hash, valid.Hash)
+	}
+
+	// the miner builds on the valid tip instead of retrying the invalid one
+	prevBlock, _, ok := NewBlockTemplate()
+	if !ok || prevBlock.Hash != valid.Hash {
+		t.Error("no block template on the valid tip")
+	}
+
+	child := mineTestBlock(t, parent, []Operation{})
+	if err := AcceptBlock(child); err == nil {
+		t.Error("block extending the invalid branch was accepted")
+	}
+}
+
+func TestReplayRejectsBlocksThatDoNotApply(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	valid := mineTestBlock(t, blockStore.Genesis(), []Operation{newTestShape(t, artist, "M 10 10 h 20")})
+	if err := AcceptBlock(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	// signed and mined correctly, but spends more ink than the artist has
+	op := newTestShape(t, artist, "M 100 100 h 20")
+	op.OpInkCost = 5000
+	if err := blockartlib.SignOperation(&op, *artist); err != nil {
+		t.Fatal(err)
+	}
+	invalid := mineTestBlock(t, storedBlock(t, valid.Hash), []Operation{op})
+
+	// replay the blocks the way they would be read from the chain file
+	newTestChain(t, artist)
+	if err := ReplayBlock(&valid, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayBlock(&invalid, 0); err == nil {
+		t.Error("block that does not apply to its chain was replayed")
+	}
+	if ExistInLocalBlockchain(invalid.Hash) {
+		t.Error("block that does not apply to its chain was stored")
+	}
+	if tip := chainState.TipHash(); tip != valid.Hash {
+		t.Errorf("tip is %s, expected %s", tip, valid.Hash)
+	}
+}
+
+func TestSyncFromPruningMiner(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	settings.CheckpointInterval = 2
+	settings.PruneOperations = true
+
+	// a shape added and deleted again between two checkpoints, so both operations are pruned
+	add := newTestShape(t, artist, "M 10 10 h 20")
+	live := newTestShape(t, artist, "M 100 100 h 20")
+	opsAt := [][]Operation{{}, {add, live}, {newTestDelete(t, artist, add)}, {}, {}}
+
+	parent := blockStore.Genesis()
+	for _, ops := range opsAt {
+		block := mineTestBlock(t, parent, ops)
+		if err := AcceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		parent = storedBlock(t, block.Hash)
+	}
+	tip := parent
+
+	// what another miner gets from GetBlocks, oldest first
+	blocks := []Block{}
+	for block := tip; block.PreviousBlock != nil; block = block.PreviousBlock {
+		blocks = append([]Block{UnlinkBlock(*block)}, blocks...)
+	}
+	if !blocks[1].SetOPs[0].Pruned || blocks[1].SetOPs[1].Pruned || !blocks[2].SetOPs[0].Pruned {
+		t.Fatal("operations were not pruned as expected")
+	}
+	for _, block := range blocks {
+		if !bytes.Equal(blockartlib.MerkleRoot(block.SetOPs), block.MerkleRoot) {
+			t.Fatalf("operations of block %s do not match its Merkle root", block.Hash)
+		}
+	}
+
+	// a proof for the live shape is built from the leaves of the pruned operations next to it
+	var proof blockartlib.OperationProof
+	artKey := &ArtKey{Session: &ArtNodeSession{ArtNodeID: 1, PubKey: artist.PublicKey}}
+	if err := artKey.GetOperationProof(live.UniqueID, &proof); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blockartlib.VerifyOperationProof(proof); err != nil {
+		t.Error(err)
+	}
+	var headers []BlockHeader
+	if err := new(MinerKey).GetHeaders(nil, &headers); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestChain(t, artist)
+	settings.CheckpointInterval = 2
+	settings.PruneOperations = true
+
+	if err := AcceptBlock(blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := AcceptBlock(blocks[1]); err == nil {
+		t.Error("pruned block was accepted without a longer chain")
+	}
+
+	// the height the pruned operations are taken below comes from the headers this miner checked
+	height, err := CheckHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prunedHeight := PrunedHeightAt(height)
+	if prunedHeight < blocks[2].PathLength {
+		t.Fatalf("pruned height is %d, expected the blocks with pruned operations below it", prunedHeight)
+	}
+
+	// every field of a pruned operation that the chain state applies is bound to the Merkle root
+	for _, tamper := range []func(op *Operation){
+		func(op *Operation) { op.OpInkCost = 0 },
+		func(op *Operation) { op.OpType = "Reserve" },
+		func(op *Operation) { op.ArtNodePubKey = newTestKey(t).PublicKey },
+		func(op *Operation) { op.DeleteUniqueID = live.UniqueID },
+	} {
+		tampered := blocks[1]
+		tampered.SetOPs = append([]Operation{}, blocks[1].SetOPs...)
+		tamper(&tampered.SetOPs[0])
+		if err := AcceptPrunedBlock(tampered, prunedHeight); err == nil {
+			t.Error("block with a tampered pruned operation was accepted")
+		}
+	}
+
+	for _, block := range blocks[1:] {
+		if err := AcceptPrunedBlock(block, prunedHeight); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hash := chainState.TipHash(); hash != tip.Hash {
+		t.Errorf("tip is %s, expected %s", hash, tip.Hash)
+	}
+	if ink, expected := chainState.Balance(artist.PublicKey), 1000-live.OpInkCost; ink != expected {
+		t.Errorf("artist has %d ink, expected %d", ink, expected)
+	}
+}
+
+func TestExpiredOperationsAreForgotten(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	settings.CheckpointInterval = 2
+
+	// operations signed hours ago, in blocks of that time
+	signed := time.Now().Add(-3 * time.Hour)
+	signAt := func(op Operation) Operation {
+		op.Expires = testExpiry(signed)
+		if err := blockartlib.SignOperation(&op, *artist); err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+	deleted := signAt(newTestShape(t, artist, "M 10 10 h 20"))
+	live := signAt(newTestShape(t, artist, "M 100 100 h 20"))
+	deleteOp := signAt(newTestDelete(t, artist, deleted))
+
+	parent := blockStore.Genesis()
+	for i, ops := range [][]Operation{{deleted, live}, {deleteOp}} {
+		block := mineTestBlockAt(t, parent, ops, signed.Add(time.Duration(i)*time.Minute))
+		if err := AcceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		parent = storedBlock(t, block.Hash)
+	}
+	for parent.PathLength < 14 {
+		block := mineTestBlock(t, parent, []Operation{})
+		if err := AcceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		parent = storedBlock(t, block.Hash)
+	}
+
+	if chainState.CheckpointHeight() != 12 {
+		t.Fatalf("checkpoint is at %d, expected 12", chainState.CheckpointHeight())
+	}
+	for _, op := range []Operation{deleted, deleteOp} {
+		if chainState.OperationBlock(op.UniqueID) != "" {
+			t.Errorf("block of expired operation %s is still known", op.OpType)
+		}
+	}
+	if chainState.OperationBlock(live.UniqueID) == "" {
+		t.Error("block of the live shape was forgotten")
+	}
+
+	// forgotten operations can not be replayed, they expired before the blocks that could take them
+	if err := ValidateOperation(deleted, chainState); err == nil {
+		t.Error("expired operation is valid")
+	}
+	replay := mineTestBlock(t, parent, []Operation{deleted})
+	if err := AcceptBlock(replay); err == nil {
+		t.Error("block replaying an expired operation was accepted")
+	}
+}
+
+func TestOperationExpiryIsBounded(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+
+	op := newTestShape(t, artist, "M 10 10 h 20")
+	op.Expires = time.Now().Add(2*blockartlib.MaxOperationLifetime).UnixNano() / int64(time.Millisecond)
+	if err := blockartlib.SignOperation(&op, *artist); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateOperation(op, chainState); err == nil {
+		t.Error("operation expiring after MaxOperationLifetime is valid")
+	}
+	if err := AcceptBlock(mineTestBlock(t, blockStore.Genesis(), []Operation{op})); err == nil {
+		t.Error("block with an operation expiring after MaxOperationLifetime was accepted")
+	}
+}
+
+// Returns the headers of a chain of blocks without operations mined on top of parent, which are
+// not stored.
+func mineTestHeaders(t *testing.T, parent *Block, length int) []BlockHeader {
+	headers := []BlockHeader{}
+	for i := 0; i < length; i++ {
+		block := mineTestBlock(t, parent, []Operation{})
+		block.PreviousBlock = parent
+		block.PathLength = parent.PathLength + 1
+		headers = append(headers, BlockHeader{BlockHeader: HeaderOf(block), Hash: block.Hash, PathLength: block.PathLength})
+		parent = &block
+	}
+	return headers
+}
+
+func TestCheckHeadersComputesHeightsFromParent(t *testing.T) {
+	newTestChain(t)
+	genesis := blockStore.Genesis()
+
+	headers := mineTestHeaders(t, genesis, 3)
+	if height, err := CheckHeaders(headers); err != nil || height != genesis.PathLength+3 {
+		t.Fatalf("headers are at height %d (%v), expected %d", height, err, genesis.PathLength+3)
+	}
+
+	// a miner can not claim a longer chain than the headers it sends
+	forged := append([]BlockHeader{}, headers...)
+	forged[2].PathLength = 100
+	if _, err := CheckHeaders(forged); err == nil {
+		t.Error("header with a forged height is accepted")
+	}
+
+	unlinked := append([]BlockHeader{}, headers...)
+	unlinked[1].PreviousHash = "unknown"
+	if _, err := CheckHeaders(unlinked); err == nil {
+		t.Error("headers that do not form a chain are accepted")
+	}
+	if _, err := CheckHeaders(headers[1:]); err == nil {
+		t.Error("headers that do not start from a stored block are accepted")
+	}
+}
+
+func TestCheckHeadersChecksProofOfWork(t *testing.T) {
+	newTestChain(t)
+	header := mineTestHeaders(t, blockStore.Genesis(), 1)[0]
+
+	// the hash has to match the header
+	renamed := header
+	renamed.Hash = strings.Repeat("0", len(header.Hash))
+	if _, err := CheckHeaders([]BlockHeader{renamed}); err == nil {
+		t.Error("header with a hash that does not match it is accepted")
+	}
+
+	// and meet the target
+	unmined := header
+	for unmined.Hash = unmined.BlockHeader.Hash(); blockartlib.HashMeetsTarget(unmined.Hash, header.Target); unmined.Hash = unmined.BlockHeader.Hash() {
+		unmined.Nonce++
+	}
+	if _, err := CheckHeaders([]BlockHeader{unmined}); err == nil {
+		t.Error("header that does not meet its target is accepted")
+	}
+
+	// which has to be the one its parent calls for
+	easy := header
+	easy.Target = blockartlib.MaxTarget
+	easy.Hash = easy.BlockHeader.Hash()
+	if _, err := CheckHeaders([]BlockHeader{easy}); err == nil {
+		t.Error("header with an easier target than its parent calls for is accepted")
+	}
+}
+
+func TestOrphanTargetIsBounded(t *testing.T) {
+	newTestChain(t)
+	parent := mineTestBlock(t, blockStore.Genesis(), []Operation{})
+	parent.PathLength = blockStore.Genesis().PathLength + 1
+
+	var reply string
+	orphan := mineTestBlock(t, &parent, []Operation{})
+	if err := new(MinerKey).ReceiveBlock(BlockMessage{Block: orphan}, &reply); err != nil || !orphanPool.Contains(orphan.Hash) {
+		t.Fatalf("orphan with the chain target is not pooled: %v", err)
+	}
+
+	// an orphan can not pick a target its hash meets without work
+	template := Block{
+		Version:      blockartlib.BlockVersion,
+		PreviousHash: parent.Hash,
+		MinerPubKey:  pubKey,
+		MerkleRoot:   blockartlib.MerkleRoot(nil),
+		Target:       blockartlib.MaxTarget,
+		Timestamp:    orphan.Timestamp,
+	}
+	easy, found := MineBlock(template, RequiredTarget(template), 1, nil)
+	if !found {
+		t.Fatal("no block mined")
+	}
+	if err := new(MinerKey).ReceiveBlock(BlockMessage{Block: easy}, &reply); err == nil || orphanPool.Contains(easy.Hash) {
+		t.Error("orphan with an easier target than the chain allows is pooled")
+	}
+
+	// unless retargeting can have eased the target that far: once within MaxOrphanBlocks blocks
+	settings.TargetBlockInterval = 1000
+	settings.RetargetWindow = 1000
+	expected := new(big.Int).Mul(blockStore.Genesis().Target, big.NewInt(blockartlib.MaxRetargetFactor))
+	if target := MaxOrphanTarget(); target.Cmp(expected) != 0 {
+		t.Errorf("orphans may carry target %x, expected %x", target, expected)
+	}
+}
+
+func TestImportBlockChecksShapes(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	op := newTestShape(t, artist, "M 10 10 h 20")
+	block := mineTestBlock(t, blockStore.Genesis(), []Operation{op})
+
+	exported := ExportBlock(block, 2)
+	if _, err := ImportBlock(exported); err != nil {
+		t.Fatal(err)
+	}
+
+	exported.Operations[0].SvgString = "M 5"
+	if _, err := ImportBlock(exported); err == nil {
+		t.Error("block with a malformed shape is imported")
+	}
+}
+
+func TestOperationValidatedOnLongestChain(t *testing.T) {
+	artist := newTestKey(t)
+	newTestChain(t, artist)
+	op := newTestShape(t, artist, "M 10 10 h 20")
+
+	withOp := addTestBlock(blockStore.Genesis(), "withOp", newTestKey(t), op)
+	SetLongestChain(addTestBlock(withOp, "child", newTestKey(t)))
+
+	block, valid := CheckOperationValidation(op.UniqueID)
+	if !valid || block.Hash != withOp.Hash {
+		t.Errorf("operation is validated in %q (%v), expected %q", block.Hash, valid, withOp.Hash)
+	}
+}
+
+func TestLongestChainFollowsReorgs(t *testing.T) {
+	newTestChain(t)
+	genesis := blockStore.Genesis()
+	miner := newTestKey(t)
+
+	first := addTestBlock(addTestBlock(genesis, "a1", miner), "a2", miner)
+	SetLongestChain(first)
+	fork := addTestBlock(addTestBlock(addTestBlock(genesis, "b1", miner), "b2", miner), "b3", miner)
+	SetLongestChain(fork)
+
+	if hashes := fmt.Sprint(blockHashes(globalChain[1:])); hashes != "[b1 b2 b3]" {
+		t.Errorf("longest chain is %v after the reorg", hashes)
+	}
+
+	SetLongestChain(fork.PreviousBlock)
+	if hashes := fmt.Sprint(blockHashes(globalChain[1:])); hashes != "[b1 b2]" {
+		t.Errorf("longest chain is %v after moving back", hashes)
+	}
+}
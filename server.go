@@ -100,6 +100,38 @@ type MinerNetSettings struct {
 
 	// Canvas settings
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
+
+	// Blocks between checkpoints of the chain state (0 disables checkpoints)
+	CheckpointInterval uint32 `json:"checkpoint-interval"`
+
+	// Whether miners drop operations older than the last checkpoint that are not live shapes
+	PruneOperations bool `json:"prune-operations"`
+
+	// Contents of the genesis block, genesis-block-hash has to be derived from them
+	Genesis GenesisSettings `json:"genesis"`
+
+	// Milliseconds per block the difficulty is adjusted toward, every retarget-window blocks
+	// (0 disables retargeting)
+	TargetBlockInterval uint32 `json:"target-block-interval"`
+	RetargetWindow      uint32 `json:"retarget-window"`
+}
+
+// Ink handed out and shapes placed on the canvas by the genesis block.
+type GenesisSettings struct {
+	Allocations []GenesisAllocation `json:"allocations"`
+	Shapes      []GenesisShape      `json:"shapes"`
+}
+
+type GenesisAllocation struct {
+	PubKey string `json:"pub-key"`
+	Ink    uint32 `json:"ink"`
+}
+
+type GenesisShape struct {
+	PubKey    string `json:"pub-key"`
+	SvgString string `json:"svg-string"`
+	Fill      string `json:"fill"`
+	Stroke    string `json:"stroke"`
 }
 
 type RServer int